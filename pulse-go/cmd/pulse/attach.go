@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// errDetached ends the input of an attached container when the detach keys are typed
+var errDetached = errors.New("detached")
+
+var attachCmdFlags struct {
+	detachKeys string
+}
+
+var attachCmd = &cobra.Command{
+	Use:   "attach [--detach-keys ctrl-p,ctrl-q] <container>",
+	Short: "Attach this terminal to a running container's input and output",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keys, err := parseDetachKeys(attachCmdFlags.detachKeys)
+		if err != nil {
+			fmt.Println("❌", err)
+			os.Exit(1)
+		}
+
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println("ERROR", err)
+			os.Exit(1)
+		}
+
+		stream, header, err := openStream(client, "/containers/"+url.PathEscape(args[0])+"/attach", nil)
+		if err != nil {
+			fmt.Println("❌", err)
+			os.Exit(1)
+		}
+
+		// Keys only reach a container's terminal as typed if this one is raw too
+		restore := func() {}
+		if header.Get("Pulse-Tty") == "true" {
+			if restore, err = rawTerminal(); err != nil {
+				stream.Close()
+				fmt.Println("❌ Failed to set up terminal:", err)
+				os.Exit(1)
+			}
+		}
+		status, err := followStream(stream, &detachReader{r: os.Stdin, keys: keys})
+		restore()
+
+		switch {
+		case err == errDetached:
+			fmt.Printf("\n🔌 Detached from container %s, which keeps running\n", args[0])
+		case err != nil:
+			fmt.Println("❌", err)
+			os.Exit(1)
+		case status.Error != "":
+			fmt.Println(status)
+			os.Exit(1)
+		default:
+			os.Exit(status.Code())
+		}
+	},
+}
+
+// parseDetachKeys turns a comma-separated key sequence such as "ctrl-p,ctrl-q" into the
+// bytes a terminal sends for it. Keys are single characters or ctrl- followed by a
+// letter or one of @[\]^_. An empty sequence disables detaching.
+func parseDetachKeys(spec string) ([]byte, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	var keys []byte
+	for _, key := range strings.Split(spec, ",") {
+		switch {
+		case len(key) == 1:
+			keys = append(keys, key[0])
+		case len(key) == 6 && strings.HasPrefix(strings.ToLower(key), "ctrl-"):
+			c := key[5]
+			switch {
+			case c >= 'a' && c <= 'z':
+				keys = append(keys, c-'a'+1)
+			case c >= 'A' && c <= 'Z':
+				keys = append(keys, c-'A'+1)
+			case strings.IndexByte("@[\\]^_", c) >= 0:
+				keys = append(keys, c-'@')
+			default:
+				return nil, fmt.Errorf("invalid detach key %q", key)
+			}
+		default:
+			return nil, fmt.Errorf("invalid detach key %q", key)
+		}
+	}
+	return keys, nil
+}
+
+// detachReader passes reads of r on, except for the detach key sequence, which ends
+// them with errDetached. Keys that may start the sequence are held back until the next
+// key shows whether they do.
+type detachReader struct {
+	r       io.Reader
+	keys    []byte
+	matched int
+}
+
+func (d *detachReader) Read(p []byte) (int, error) {
+	if len(d.keys) == 0 {
+		return d.r.Read(p)
+	}
+	// Leave room for held back keys that turn out not to be the sequence
+	if len(p) <= len(d.keys) {
+		return 0, io.ErrShortBuffer
+	}
+	buf := make([]byte, len(p)-len(d.keys))
+	n, err := d.r.Read(buf)
+
+	out := p[:0]
+	for _, b := range buf[:n] {
+		if b == d.keys[d.matched] {
+			d.matched++
+			if d.matched == len(d.keys) {
+				return len(out), errDetached
+			}
+			continue
+		}
+		out = append(out, d.keys[:d.matched]...)
+		d.matched = 0
+		if b == d.keys[0] {
+			d.matched = 1
+			continue
+		}
+		out = append(out, b)
+	}
+	return len(out), err
+}
+
+func init() {
+	attachCmd.Flags().StringVar(&attachCmdFlags.detachKeys, "detach-keys", "ctrl-p,ctrl-q", "Key sequence that detaches and leaves the container running")
+	rootCmd.AddCommand(attachCmd)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var containerPruneFilters []string
+
+var containerCmd = &cobra.Command{
+	Use:   "container",
+	Short: "Manage containers",
+}
+
+var containerPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove all stopped containers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := postPrune("http://unix/containers/prune", false, containerPruneFilters)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+
+		for _, id := range report.Deleted {
+			fmt.Println("Deleted:", internals.ShortID(id))
+		}
+		fmt.Printf("Total reclaimed space: %s\n", humanSize(report.Reclaimed))
+	},
+}
+
+// containerAction posts a lifecycle action (start, stop, ...) for each container and
+// prints the daemon's answer, exiting 1 if any of them failed
+func containerAction(containers []string, action string, query url.Values) {
+	client, err := getDaemonClient()
+	if err != nil {
+		fmt.Println("ERROR", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, ref := range containers {
+		target := fmt.Sprintf("http://unix/containers/%s/%s?%s", url.PathEscape(ref), action, query.Encode())
+		resp, err := client.Post(target, "application/json", nil)
+		if err != nil {
+			fmt.Println("❌ Failed to connect to daemon:", err)
+			os.Exit(1)
+		}
+
+		var result struct {
+			Message string `json:"message"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			fmt.Printf("❌ Invalid response from daemon (%d): %v\n", resp.StatusCode, err)
+			failed = true
+		case resp.StatusCode != http.StatusOK:
+			fmt.Println("❌", result.Message)
+			failed = true
+		default:
+			fmt.Println(result.Message)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	containerPruneCmd.Flags().StringArrayVar(&containerPruneFilters, "filter", nil, "Filter containers: until=<duration|timestamp>, label=<key>[=<value>] (image labels)")
+
+	containerCmd.AddCommand(containerPruneCmd)
+	rootCmd.AddCommand(containerCmd)
+}
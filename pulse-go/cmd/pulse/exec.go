@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var execCmdFlags struct {
+	interactive bool
+	tty         bool
+	envVars     []string
+	user        string
+	workdir     string
+}
+
+var execCmd = &cobra.Command{
+	Use:   "exec [-it] [-e NAME=value] [-u user] [-w dir] <container> <command> [args...]",
+	Short: "Run a command in a running container",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := internals.ExecOptions{
+			Cmd:        args[1:],
+			Env:        expandEnv(execCmdFlags.envVars),
+			User:       execCmdFlags.user,
+			WorkingDir: execCmdFlags.workdir,
+		}
+
+		// Input without a terminal is a pipe the daemon stream cannot close, so like
+		// `run -i`, exec -i runs here, attached to this process's stdio
+		if execCmdFlags.interactive && !execCmdFlags.tty {
+			if os.Geteuid() != 0 {
+				fmt.Println("❌ Joining a container's namespaces requires root privileges")
+				fmt.Println("   Please run with sudo:")
+				fmt.Printf("   sudo pulse exec -i %s ...\n", args[0])
+				os.Exit(1)
+			}
+			container, err := internals.LoadContainer(args[0])
+			if err != nil {
+				fmt.Println("❌", err)
+				os.Exit(1)
+			}
+
+			// Ctrl-C is for the command in the container, which gets it from the terminal
+			signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+			code, err := internals.ExecContainer(context.Background(), container, opts, os.Stdin, os.Stdout, os.Stderr)
+			if err != nil {
+				fmt.Println("❌ Exec failed:", err)
+				os.Exit(1)
+			}
+			os.Exit(code)
+		}
+
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println("ERROR", err)
+			os.Exit(1)
+		}
+
+		req := map[string]any{
+			"cmd":     opts.Cmd,
+			"env":     opts.Env,
+			"user":    opts.User,
+			"workdir": opts.WorkingDir,
+			"tty":     execCmdFlags.tty,
+		}
+		if execCmdFlags.tty {
+			stream, _, err := openStream(client, "/containers/"+url.PathEscape(args[0])+"/exec", req)
+			if err != nil {
+				fmt.Println("❌", err)
+				os.Exit(1)
+			}
+			status, err := followTerminal(stream)
+			if err != nil {
+				fmt.Println("❌", err)
+				os.Exit(1)
+			}
+			if status.Error != "" {
+				fmt.Println("❌ Exec failed:", status.Error)
+				os.Exit(1)
+			}
+			os.Exit(status.ExitCode)
+		}
+
+		body, _ := json.Marshal(req)
+		resp, err := client.Post("http://unix/containers/"+url.PathEscape(args[0])+"/exec", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			fmt.Println("❌ Failed to connect to daemon:", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			fmt.Printf("❌ Daemon error (%d): %s", resp.StatusCode, string(msg))
+			os.Exit(1)
+		}
+
+		io.Copy(os.Stdout, resp.Body)
+
+		// The trailer is only there once the body has been read to the end
+		code, err := strconv.Atoi(resp.Trailer.Get("Pulse-Exit-Code"))
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	execCmd.Flags().BoolVarP(&execCmdFlags.interactive, "interactive", "i", false, "Keep stdin attached; without -t, runs directly instead of through the daemon (requires root)")
+	execCmd.Flags().BoolVarP(&execCmdFlags.tty, "tty", "t", false, "Allocate a pseudo-terminal for the command")
+	execCmd.Flags().StringSliceVarP(&execCmdFlags.envVars, "env", "e", nil, "Env variables: -e FOO=bar")
+	execCmd.Flags().StringVarP(&execCmdFlags.user, "user", "u", "", "Username or UID (format: <name|uid>[:<group|gid>])")
+	execCmd.Flags().StringVarP(&execCmdFlags.workdir, "workdir", "w", "", "Working directory inside the container")
+
+	// Flags after the container belong to the command
+	execCmd.Flags().SetInterspersed(false)
+
+	rootCmd.AddCommand(execCmd)
+}
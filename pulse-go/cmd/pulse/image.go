@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var imagePruneFlags struct {
+	all     bool
+	filters []string
+}
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Manage images",
+}
+
+var imagePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove unused images and reclaim their blobs and layers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		report, err := postPrune("http://unix/images/prune", imagePruneFlags.all, imagePruneFlags.filters)
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+
+		for _, name := range report.Deleted {
+			fmt.Println("Deleted:", name)
+		}
+		if gc := report.GC; gc != nil {
+			fmt.Printf("Removed %d blobs, %d layers and %d leftovers\n", gc.Blobs, gc.Layers, gc.Other)
+		}
+		fmt.Printf("Total reclaimed space: %s\n", humanSize(report.Reclaimed))
+	},
+}
+
+// postPrune sends a prune request to the daemon and decodes its report
+func postPrune(url string, all bool, filters []string) (*internals.PruneReport, error) {
+	client, err := getDaemonClient()
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(map[string]any{"all": all, "filters": filters})
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to daemon: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("daemon error (%d): %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var report internals.PruneReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return nil, fmt.Errorf("invalid response from daemon: %v", err)
+	}
+	return &report, nil
+}
+
+func init() {
+	imagePruneCmd.Flags().BoolVarP(&imagePruneFlags.all, "all", "a", false, "Remove all images not used by any container, not just dangling ones")
+	imagePruneCmd.Flags().StringArrayVar(&imagePruneFlags.filters, "filter", nil, "Filter images: until=<duration|timestamp>, label=<key>[=<value>], label!=<key>[=<value>]")
+
+	imageCmd.AddCommand(imagePruneCmd)
+	rootCmd.AddCommand(imageCmd)
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
 )
 
 var imagesCmd = &cobra.Command{
@@ -31,7 +34,7 @@ var imagesCmd = &cobra.Command{
 			return
 		}
 
-		var images []map[string]string
+		var images []internals.ImageSummary
 		if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
 			fmt.Println(" Invalid response from daemon:", err)
 			return
@@ -42,14 +45,46 @@ var imagesCmd = &cobra.Command{
 			return
 		}
 
-		fmt.Printf("%-30s %-20s\n", "IMAGE", "LAST MODIFIED")
-		fmt.Println("-----------------------------------------------------------")
+		fmt.Printf("%-30s %-12s %-14s %-14s %-16s %s\n", "REPOSITORY", "TAG", "DIGEST", "PLATFORM", "CREATED", "SIZE")
 		for _, img := range images {
-			fmt.Printf("%-30s %-20s\n", img["name"], img["modified"])
+			tag := img.Tag
+			if tag == "" {
+				tag = "<none>"
+			}
+			created := "N/A"
+			if !img.Created.IsZero() {
+				created = humanDuration(time.Since(img.Created)) + " ago"
+			}
+			fmt.Printf("%-30s %-12s %-14s %-14s %-16s %s\n",
+				truncate(img.Repository, 30),
+				truncate(tag, 12),
+				shortDigest(imageDigest(img)),
+				img.Platform,
+				created,
+				humanSize(img.Size),
+			)
 		}
 	},
 }
 
+// imageDigest prefers the digest the reference resolved to in the registry, which is
+// what `pulse pull name@digest` takes
+func imageDigest(img internals.ImageSummary) string {
+	if img.RepoDigest != "" {
+		return img.RepoDigest
+	}
+	return img.Digest
+}
+
+// shortDigest keeps the first 12 hex characters, like image IDs in Docker
+func shortDigest(digest string) string {
+	hex := strings.TrimPrefix(digest, "sha256:")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
+
 func init() {
 	rootCmd.AddCommand(imagesCmd)
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var killSignal string
+
+var killCmd = &cobra.Command{
+	Use:   "kill [-s signal] <container>...",
+	Short: "Send a signal to running containers",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// Catch typos before reaching the daemon
+		if _, err := internals.ParseSignal(killSignal); err != nil {
+			fmt.Println("❌", err)
+			os.Exit(1)
+		}
+		containerAction(args, "kill", url.Values{"signal": {killSignal}})
+	},
+}
+
+func init() {
+	killCmd.Flags().StringVarP(&killSignal, "signal", "s", "KILL", "Signal to send, by name (TERM, SIGHUP) or number")
+	rootCmd.AddCommand(killCmd)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+	"golang.org/x/term"
+)
+
+var loginFlags struct {
+	username      string
+	password      string
+	passwordStdin bool
+}
+
+var loginCmd = &cobra.Command{
+	Use:   "login [-u user] [-p password | --password-stdin] [registry]",
+	Short: "Log in to a registry (default: docker.io)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		registry := "docker.io"
+		if len(args) == 1 {
+			registry = args[0]
+		}
+
+		u, err := user.Current()
+		if err != nil {
+			fmt.Println("❌ Failed to look up the current user:", err)
+			return
+		}
+
+		username, password, err := readLoginCredentials()
+		if err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+
+		// Credentials are checked and stored here, as the calling user; the daemon reads
+		// them from this user's auth file when the user pulls
+		if err := internals.Login(u, registry, username, password); err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("✅ Login succeeded, credentials saved to %s\n", internals.AuthFilePath(u))
+	},
+}
+
+// readLoginCredentials takes the flags, or prompts for what is missing
+func readLoginCredentials() (string, string, error) {
+	username, password := loginFlags.username, loginFlags.password
+	stdin := bufio.NewReader(os.Stdin)
+
+	if loginFlags.passwordStdin {
+		if password != "" {
+			return "", "", fmt.Errorf("--password and --password-stdin are mutually exclusive")
+		}
+		if username == "" {
+			return "", "", fmt.Errorf("--password-stdin requires --username")
+		}
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read password: %v", err)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+
+	if username == "" {
+		fmt.Print("Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", "", fmt.Errorf("failed to read username: %v", err)
+		}
+		username = strings.TrimSpace(line)
+	}
+	if password == "" {
+		fmt.Print("Password: ")
+		data, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read password: %v", err)
+		}
+		password = string(data)
+	}
+
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("username and password are required")
+	}
+	return username, password, nil
+}
+
+func init() {
+	loginCmd.Flags().StringVarP(&loginFlags.username, "username", "u", "", "Registry username")
+	loginCmd.Flags().StringVarP(&loginFlags.password, "password", "p", "", "Registry password or token")
+	loginCmd.Flags().BoolVar(&loginFlags.passwordStdin, "password-stdin", false, "Read the password from stdin")
+	rootCmd.AddCommand(loginCmd)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout [registry]",
+	Short: "Remove the stored credentials for a registry (default: docker.io)",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		registry := "docker.io"
+		if len(args) == 1 {
+			registry = args[0]
+		}
+
+		u, err := user.Current()
+		if err != nil {
+			fmt.Println("❌ Failed to look up the current user:", err)
+			return
+		}
+		if err := internals.Logout(u, registry); err != nil {
+			fmt.Println("❌", err)
+			return
+		}
+		fmt.Printf("👋 Removed login credentials for %s\n", internals.NormalizeRegistry(registry))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logoutCmd)
+}
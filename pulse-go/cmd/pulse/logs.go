@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var logsCmdFlags struct {
+	follow bool
+	tail   string
+	since  string
+}
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <container>",
+	Short: "Show the output of a container",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		if logsCmdFlags.follow {
+			query.Set("follow", "1")
+		}
+		query.Set("tail", logsCmdFlags.tail)
+		if logsCmdFlags.since != "" {
+			since, err := parseSince(logsCmdFlags.since)
+			if err != nil {
+				fmt.Println("❌", err)
+				os.Exit(1)
+			}
+			query.Set("since", since.Format(time.RFC3339Nano))
+		}
+
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println("ERROR", err)
+			return
+		}
+
+		resp, err := client.Get(fmt.Sprintf("http://unix/containers/%s/logs?%s", url.PathEscape(args[0]), query.Encode()))
+		if err != nil {
+			fmt.Println("❌ Failed to connect to daemon:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Printf("❌ Daemon error (%d): %s", resp.StatusCode, string(body))
+			os.Exit(1)
+		}
+
+		io.Copy(os.Stdout, resp.Body)
+	},
+}
+
+// parseSince accepts a relative duration (10m, 2h) or an RFC3339 timestamp
+func parseSince(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since value %q (use a duration like 10m or an RFC3339 timestamp)", value)
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsCmdFlags.follow, "follow", "f", false, "Follow log output")
+	logsCmd.Flags().StringVarP(&logsCmdFlags.tail, "tail", "n", "all", "Number of lines to show from the end of the logs")
+	logsCmd.Flags().StringVar(&logsCmdFlags.since, "since", "", "Show logs since a timestamp or relative duration (e.g. 10m)")
+	rootCmd.AddCommand(logsCmd)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vishnucs/pulse-go/internals"
+	"golang.org/x/term"
+)
+
+const progressBarWidth = 30
+
+// pullRenderer prints pull events with one line per blob. On a terminal a blob's line
+// is redrawn in place as it downloads; otherwise only changes of state are printed.
+type pullRenderer struct {
+	out    io.Writer
+	tty    bool
+	lines  int            // lines printed so far
+	blobs  map[string]int // line of each blob
+	status map[string]string
+}
+
+// renderPullProgress reads the daemon's pull events from r until the stream ends
+func renderPullProgress(out *os.File, r io.Reader) error {
+	p := &pullRenderer{
+		out:    out,
+		tty:    term.IsTerminal(int(out.Fd())),
+		blobs:  map[string]int{},
+		status: map[string]string{},
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		var event internals.PullEvent
+		if err := decoder.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p.render(event)
+	}
+}
+
+func (p *pullRenderer) render(event internals.PullEvent) {
+	if event.ID == "" {
+		if event.Status == internals.PullStatusDone && event.Digest != "" {
+			p.println("Digest: " + event.Digest)
+		}
+		if event.Message != "" {
+			p.println(event.Message)
+		}
+		return
+	}
+
+	line := fmt.Sprintf("%s: %s", shortDigest(event.ID), blobStatus(event))
+	if !p.tty {
+		if p.status[event.ID] != event.Status {
+			p.status[event.ID] = event.Status
+			p.println(line)
+		}
+		return
+	}
+
+	n, ok := p.blobs[event.ID]
+	if !ok {
+		p.blobs[event.ID] = p.lines
+		p.println(line)
+		return
+	}
+	// Go up to the blob's line, rewrite it and come back down
+	up := p.lines - n
+	fmt.Fprintf(p.out, "\033[%dA\r\033[2K%s\033[%dB\r", up, line, up)
+}
+
+func (p *pullRenderer) println(line string) {
+	fmt.Fprintln(p.out, line)
+	p.lines++
+}
+
+func blobStatus(event internals.PullEvent) string {
+	switch event.Status {
+	case internals.PullStatusExists:
+		return "Already exists"
+	case internals.PullStatusComplete:
+		return "Download complete"
+	case internals.PullStatusDownloading:
+		if event.Total <= 0 {
+			return fmt.Sprintf("Downloading %s", humanSize(event.Current))
+		}
+		return fmt.Sprintf("Downloading %s %s/%s", progressBar(event.Current, event.Total), humanSize(event.Current), humanSize(event.Total))
+	}
+	return event.Status
+}
+
+// progressBar draws [=====>     ] for current out of total
+func progressBar(current, total int64) string {
+	filled := int(current * progressBarWidth / total)
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return "[" + bar + "]"
+}
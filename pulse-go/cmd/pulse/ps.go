@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var psAll bool
+
+var psCmd = &cobra.Command{
+	Use:   "ps",
+	Short: "List containers",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		url := "http://unix/containers"
+		if psAll {
+			url += "?all=1"
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			fmt.Println(" Failed to reach daemon:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Printf(" Daemon error (%d): %s\n", resp.StatusCode, string(body))
+			return
+		}
+
+		var containers []internals.Container
+		if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+			fmt.Println(" Invalid response from daemon:", err)
+			return
+		}
+
+		fmt.Printf("%-14s %-20s %-24s %-16s %-26s %s\n", "CONTAINER ID", "IMAGE", "COMMAND", "CREATED", "STATUS", "NAMES")
+		for _, c := range containers {
+			fmt.Printf("%-14s %-20s %-24s %-16s %-26s %s\n",
+				internals.ShortID(c.ID),
+				truncate(internals.FamiliarImage(c.Image), 20),
+				truncate(fmt.Sprintf("%q", strings.Join(c.Command, " ")), 24),
+				humanDuration(time.Since(c.Created))+" ago",
+				containerStatus(c),
+				c.Name,
+			)
+		}
+	},
+}
+
+func containerStatus(c internals.Container) string {
+	switch c.State {
+	case internals.StateRunning:
+		return "Up " + humanDuration(time.Since(c.StartedAt))
+	case internals.StateExited:
+		if c.ExitCode == internals.ExitCodeUnknown {
+			return "Exited " + humanDuration(time.Since(c.FinishedAt)) + " ago"
+		}
+		return fmt.Sprintf("Exited (%d) %s ago", c.ExitCode, humanDuration(time.Since(c.FinishedAt)))
+	default:
+		return "Created"
+	}
+}
+
+func humanDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%d seconds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%d hours", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%d days", int(d.Hours()/24))
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "…"
+}
+
+func init() {
+	psCmd.Flags().BoolVarP(&psAll, "all", "a", false, "Show all containers (default shows just running)")
+	rootCmd.AddCommand(psCmd)
+}
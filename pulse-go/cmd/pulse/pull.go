@@ -5,24 +5,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/signal"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	pullPlatform string
+	pullAlways   bool
+	pullFormat   string
+)
+
 var pullCmd = &cobra.Command{
-	Use:   "pull <image>",
+	Use:   "pull [--always] <image>[:tag|@digest]",
 	Short: "pull an image via the pulse daemon",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		image := args[0]
+		if pullFormat != "" && pullFormat != "json" {
+			fmt.Printf("❌ Unknown format %q, expected json\n", pullFormat)
+			return
+		}
 		client, err := getDaemonClient()
 		if err != nil {
 			fmt.Println("Error", err)
 			return
 		}
 
-		body, _ := json.Marshal(map[string]string{"image": image})
+		body, _ := json.Marshal(map[string]any{"image": image, "platform": pullPlatform, "always": pullAlways})
 		resp, err := client.Post("http://unix/pull", "application/json", bytes.NewBuffer(body))
 		if err != nil {
 			fmt.Println("❌ Failed to connect to daemon:", err)
@@ -30,11 +42,51 @@ var pullCmd = &cobra.Command{
 		}
 		defer resp.Body.Close()
 
-		io.Copy(os.Stdout, resp.Body)
+		// Ctrl-C cancels the pull in the daemon, which ends the stream with the
+		// cancellation; a second Ctrl-C quits without waiting for it
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			signal.Stop(interrupt)
+			if err := cancelPull(client, resp.Header.Get("Pulse-Pull-ID")); err != nil {
+				os.Exit(130)
+			}
+		}()
 
+		if resp.StatusCode != http.StatusOK || pullFormat == "json" {
+			io.Copy(os.Stdout, resp.Body)
+			return
+		}
+		if err := renderPullProgress(os.Stdout, resp.Body); err != nil {
+			fmt.Println("❌ Invalid response from daemon:", err)
+		}
 	},
 }
 
+// cancelPull asks the daemon to stop the pull with id
+func cancelPull(client *http.Client, id string) error {
+	if id == "" {
+		return fmt.Errorf("the daemon did not name the pull")
+	}
+	req, err := http.NewRequest(http.MethodDelete, "http://unix/pulls/"+id, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("daemon error (%d)", resp.StatusCode)
+	}
+	return nil
+}
+
 func init() {
+	pullCmd.Flags().StringVar(&pullPlatform, "platform", "", "Pull this platform of a multi-arch image, e.g. linux/arm64/v8 (default: host)")
+	pullCmd.Flags().BoolVar(&pullAlways, "always", false, "Check the registry for a newer image even if the tag is available locally")
+	pullCmd.Flags().StringVar(&pullFormat, "format", "", "Print the daemon's progress events as JSON lines instead of progress bars (json)")
 	rootCmd.AddCommand(pullCmd)
 }
@@ -5,24 +5,47 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 
 	"github.com/spf13/cobra"
 )
 
+var rmForce bool
+
 var rmCmd = &cobra.Command{
-	Use:   "rm <image>",
-	Short: "remove an image",
+	Use:   "rm [-f] <container|image>",
+	Short: "remove a container, or an image if no container matches",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		image := args[0]
+		target := args[0]
 		client, err := getDaemonClient()
 		if err != nil {
 			fmt.Println("ERROR", err)
 			return
 		}
-		body, _ := json.Marshal(map[string]string{"image": image})
-		resp, err := client.Post("http://unix/remove", "application/json", bytes.NewBuffer(body))
+
+		// Containers take precedence; fall back to removing an image
+		containerURL := "http://unix/containers/" + url.PathEscape(target)
+		if rmForce {
+			containerURL += "?force=1"
+		}
+		req, _ := http.NewRequest(http.MethodDelete, containerURL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Println("❌ Failed to connect to daemon:", err)
+			return
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			defer resp.Body.Close()
+			io.Copy(os.Stdout, resp.Body)
+			return
+		}
+		resp.Body.Close()
+
+		body, _ := json.Marshal(map[string]any{"image": target, "force": rmForce})
+		resp, err = client.Post("http://unix/remove", "application/json", bytes.NewBuffer(body))
 		if err != nil {
 			fmt.Println("❌ Failed to connect to daemon:", err)
 			return
@@ -35,5 +58,6 @@ var rmCmd = &cobra.Command{
 }
 
 func init() {
+	rmCmd.Flags().BoolVarP(&rmForce, "force", "f", false, "Stop a running container, or the containers using an image, before removing it")
 	rootCmd.AddCommand(rmCmd)
 }
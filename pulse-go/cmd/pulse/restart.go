@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var restartTime int
+
+var restartCmd = &cobra.Command{
+	Use:   "restart [-t seconds] <container>...",
+	Short: "Stop containers if they run and start them again in the background",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		containerAction(args, "restart", url.Values{"time": {strconv.Itoa(restartTime)}})
+	},
+}
+
+func init() {
+	restartCmd.Flags().IntVarP(&restartTime, "time", "t", 10, "Seconds to wait for the container to stop before killing it")
+	rootCmd.AddCommand(restartCmd)
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,9 +17,16 @@ import (
 var (
 	runCmdFlags struct {
 		cmd         string
+		name        string
 		envVars     []string
 		network     bool
 		interactive bool
+		tty         bool
+		detach      bool
+		entrypoint  string
+		workdir     string
+		user        string
+		platform    string
 	}
 )
 
@@ -37,11 +45,22 @@ var runCmd = &cobra.Command{
 		} else if runCmdFlags.cmd != "" {
 			// pulse run alpine --cmd "sleep 5"
 			containerCmd = strings.Split(runCmdFlags.cmd, " ")
-		} else {
-			containerCmd = []string{"/bin/sh"}
+		}
+		// Otherwise the image's Entrypoint/Cmd decide what runs
+
+		overrides := internals.RunOverrides{
+			EntrypointSet: cmd.Flags().Changed("entrypoint"),
+			Cmd:           containerCmd,
+			Env:           expandEnv(runCmdFlags.envVars),
+			WorkingDir:    runCmdFlags.workdir,
+			User:          runCmdFlags.user,
+		}
+		if runCmdFlags.entrypoint != "" {
+			overrides.Entrypoint = []string{runCmdFlags.entrypoint}
 		}
 
-		if runCmdFlags.interactive {
+		// With -d, -i keeps the container's input open for pulse attach instead
+		if runCmdFlags.interactive && !runCmdFlags.detach {
 			// Check if running as root when networking is enabled
 			if runCmdFlags.network && os.Geteuid() != 0 {
 				fmt.Println("❌ Networking requires root privileges")
@@ -64,10 +83,10 @@ var runCmd = &cobra.Command{
 			}
 
 			// Extract the image
-			rootfs, err := internals.Extract(image)
+			rootfs, err := internals.Extract(image, runCmdFlags.platform)
 			if err != nil {
 				fmt.Printf("❌ Failed to extract image: %v\n", err)
-				return
+				os.Exit(1)
 			}
 
 			// Ensure rootfs is readable when running with sudo
@@ -92,47 +111,140 @@ var runCmd = &cobra.Command{
 				fmt.Printf("🚀 Starting container (network isolated)...\n\n")
 			}
 
-			// Run container directly (not through daemon)
-			if err := internals.RunContainer(rootfs, containerCmd, runCmdFlags.envVars, runCmdFlags.network, true); err != nil {
-				fmt.Printf("\n❌ Container failed: %v\n", err)
-				return
+			config, err := internals.ResolveRunConfig(image, runCmdFlags.platform, overrides)
+			if err != nil {
+				fmt.Printf("❌ Failed to read image config: %v\n", err)
+				os.Exit(1)
 			}
 
-			fmt.Printf("\n✅ Container exited successfully\n")
-			return
+			container, err := internals.NewContainer(runCmdFlags.name, image, rootfs, config, runCmdFlags.network)
+			if err != nil {
+				fmt.Printf("❌ Failed to create container: %v\n", err)
+				os.Exit(1)
+			}
+
+			container.Tty = runCmdFlags.tty
+
+			// With a terminal, keys go to the container as typed and it follows resizes
+			var sizes <-chan internals.WindowSize
+			restore, stop := func() {}, func() {}
+			if container.Tty {
+				if restore, err = rawTerminal(); err != nil {
+					fmt.Printf("❌ Failed to set up terminal: %v\n", err)
+					os.Exit(1)
+				}
+				sizes, stop = watchTerminalSize()
+			}
+
+			// Run container directly (not through daemon)
+			err = internals.RunContainer(container, sizes)
+			stop()
+			restore()
+			status := internals.ContainerExitStatus(container)
+			if err != nil && container.State != internals.StateExited {
+				// It never started
+				status = internals.ExitStatus{ExitCode: internals.ExitCodeUnknown, Error: err.Error()}
+			}
+			fmt.Printf("\n%s\n", status)
+			os.Exit(status.Code())
 		}
 
 		client, err := getDaemonClient()
 		if err != nil {
 			fmt.Println("❌ Failed to connect runtime:", err)
-			return
+			os.Exit(1)
 		}
 
 		req := map[string]any{
 			"image":       image,
+			"platform":    runCmdFlags.platform,
+			"name":        runCmdFlags.name,
 			"cmd":         containerCmd,
-			"env":         runCmdFlags.envVars,
+			"env":         overrides.Env,
+			"workdir":     runCmdFlags.workdir,
+			"user":        runCmdFlags.user,
 			"network":     runCmdFlags.network,
-			"interactive": false,
+			"interactive": runCmdFlags.interactive,
+			"detach":      runCmdFlags.detach,
+			"tty":         runCmdFlags.tty,
+		}
+		if overrides.EntrypointSet {
+			// Always send a list so an empty --entrypoint clears the image's
+			req["entrypoint"] = append([]string{}, overrides.Entrypoint...)
+		}
+
+		if runCmdFlags.tty && !runCmdFlags.detach {
+			stream, _, err := openStream(client, "/run", req)
+			if err != nil {
+				fmt.Println("❌", err)
+				os.Exit(1)
+			}
+			status, err := followTerminal(stream)
+			if err != nil {
+				fmt.Printf("\n❌ %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("\n%s\n", status)
+			os.Exit(status.Code())
 		}
 
 		body, _ := json.Marshal(req)
 		resp, err := client.Post("http://unix/run", "application/json", bytes.NewBuffer(body))
 		if err != nil {
 			fmt.Println("❌ Failed to contact daemon:", err)
-			return
+			os.Exit(1)
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			fmt.Printf("❌ Daemon error (%d): %s", resp.StatusCode, string(msg))
+			os.Exit(1)
+		}
+
 		io.Copy(os.Stdout, resp.Body)
+		if runCmdFlags.detach {
+			return
+		}
+
+		// The trailer is only there once the body has been read to the end, and only if
+		// the container got as far as being run
+		var status internals.ExitStatus
+		if err := json.Unmarshal([]byte(resp.Trailer.Get("Pulse-Exit-Status")), &status); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(status.Code())
 	},
 }
 
+// expandEnv resolves `-e NAME` entries from the caller's environment, like Docker
+func expandEnv(envVars []string) []string {
+	var env []string
+	for _, entry := range envVars {
+		if strings.Contains(entry, "=") {
+			env = append(env, entry)
+		} else if value, ok := os.LookupEnv(entry); ok {
+			env = append(env, entry+"="+value)
+		}
+	}
+	return env
+}
+
 func init() {
 	runCmd.Flags().StringVarP(&runCmdFlags.cmd, "cmd", "c", "", "Command to run, e.g. --cmd 'sleep 5'")
+	runCmd.Flags().StringVar(&runCmdFlags.name, "name", "", "Assign a name to the container")
 	runCmd.Flags().StringSliceVarP(&runCmdFlags.envVars, "env", "e", nil, "Env variables: -e FOO=bar")
 	runCmd.Flags().BoolVarP(&runCmdFlags.network, "net", "n", false, "Enable networking")
-	runCmd.Flags().BoolVarP(&runCmdFlags.interactive, "interactive", "i", false, "Interactive mode with TTY")
+	runCmd.Flags().BoolVarP(&runCmdFlags.interactive, "interactive", "i", false, "Run here instead of through the daemon, attached to this terminal; with -d, keep stdin open for pulse attach")
+	runCmd.Flags().BoolVarP(&runCmdFlags.tty, "tty", "t", false, "Allocate a pseudo-terminal for the container")
+	runCmd.Flags().BoolVarP(&runCmdFlags.detach, "detach", "d", false, "Run container in background and print container ID")
+	runCmd.Flags().StringVar(&runCmdFlags.entrypoint, "entrypoint", "", "Overwrite the default ENTRYPOINT of the image")
+	runCmd.Flags().StringVarP(&runCmdFlags.workdir, "workdir", "w", "", "Working directory inside the container")
+	runCmd.Flags().StringVarP(&runCmdFlags.user, "user", "u", "", "Username or UID (format: <name|uid>[:<group|gid>])")
+	runCmd.Flags().StringVar(&runCmdFlags.platform, "platform", "", "Platform of a multi-arch image, e.g. linux/arm64/v8 (default: host)")
+
+	// Flags after the image belong to the container command
+	runCmd.Flags().SetInterspersed(false)
 
 	rootCmd.AddCommand(runCmd)
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var startCmd = &cobra.Command{
+	Use:   "start <container>...",
+	Short: "Start stopped containers in the background, keeping their filesystem",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		containerAction(args, "start", nil)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(startCmd)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var stopTime int
+
+var stopCmd = &cobra.Command{
+	Use:   "stop [-t seconds] <container>...",
+	Short: "Stop running containers: SIGTERM, then SIGKILL after a grace period",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		containerAction(args, "stop", url.Values{"time": {strconv.Itoa(stopTime)}})
+	},
+}
+
+func init() {
+	stopCmd.Flags().IntVarP(&stopTime, "time", "t", 10, "Seconds to wait for the container to stop before killing it")
+	rootCmd.AddCommand(stopCmd)
+}
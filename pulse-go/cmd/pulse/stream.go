@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+// openStream posts body to the daemon asking for the connection to be switched over
+// to a container stream. The headers are those of the daemon's answer.
+func openStream(client *http.Client, path string, body any) (io.ReadWriteCloser, http.Header, error) {
+	data, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, "http://unix"+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", internals.StreamUpgrade)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to contact daemon: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, nil, fmt.Errorf("daemon error (%d): %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	// The body of a 101 response is the connection itself
+	stream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("daemon did not switch to a stream")
+	}
+	return stream, resp.Header, nil
+}
+
+// followTerminal is followStream for a container terminal driven from this one: this
+// terminal is put in raw mode, so keys (Ctrl-C included) reach the container as typed,
+// and what is typed is sent as its input
+func followTerminal(stream io.ReadWriteCloser) (internals.ExitStatus, error) {
+	restore, err := rawTerminal()
+	if err != nil {
+		stream.Close()
+		return internals.ExitStatus{}, fmt.Errorf("failed to set up terminal: %v", err)
+	}
+	defer restore()
+	return followStream(stream, os.Stdin)
+}
+
+// followStream copies the container's output to stdout and stderr and keeps it
+// informed of the size of this terminal, until the stream ends with the exit status.
+// What is read from stdin, unless it is nil, is sent as input; if reading it fails with
+// errDetached, followStream leaves the stream and returns that error.
+func followStream(stream io.ReadWriteCloser, stdin io.Reader) (internals.ExitStatus, error) {
+	defer stream.Close()
+
+	sizes, stop := watchTerminalSize()
+	defer stop()
+	writer := internals.NewStreamWriter(stream)
+	go func() {
+		for size := range sizes {
+			if writer.WriteJSON(internals.StreamResize, size) != nil {
+				return
+			}
+		}
+	}()
+
+	detached := make(chan struct{})
+	if stdin != nil {
+		// Left behind blocked on stdin once the stream ends
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := stdin.Read(buf)
+				if n > 0 && writer.WriteFrame(internals.StreamStdin, buf[:n]) != nil {
+					return
+				}
+				if err == errDetached {
+					close(detached)
+					stream.Close()
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		kind, payload, err := internals.ReadFrame(stream)
+		if err != nil {
+			select {
+			case <-detached:
+				return internals.ExitStatus{}, errDetached
+			default:
+			}
+			return internals.ExitStatus{}, fmt.Errorf("lost the container stream: %v", err)
+		}
+		switch kind {
+		case internals.StreamStdout:
+			os.Stdout.Write(payload)
+		case internals.StreamStderr:
+			os.Stderr.Write(payload)
+		case internals.StreamExit:
+			var status internals.ExitStatus
+			if err := json.Unmarshal(payload, &status); err != nil {
+				return internals.ExitStatus{}, fmt.Errorf("invalid exit status: %v", err)
+			}
+			return status, nil
+		}
+	}
+}
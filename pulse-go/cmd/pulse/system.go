@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var systemCmd = &cobra.Command{
+	Use:   "system",
+	Short: "Manage pulse",
+}
+
+var systemDFCmd = &cobra.Command{
+	Use:   "df",
+	Short: "Show disk usage of images, containers and volumes",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		resp, err := client.Get("http://unix/system/df")
+		if err != nil {
+			fmt.Println(" Failed to reach daemon:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Printf(" Daemon error (%d): %s\n", resp.StatusCode, string(body))
+			return
+		}
+
+		var rows []internals.DiskUsageRow
+		if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+			fmt.Println(" Invalid response from daemon:", err)
+			return
+		}
+
+		fmt.Printf("%-15s %-8s %-8s %-10s %s\n", "TYPE", "TOTAL", "ACTIVE", "SIZE", "RECLAIMABLE")
+		for _, row := range rows {
+			reclaimable := humanSize(row.Reclaimable)
+			if row.Size > 0 {
+				reclaimable += fmt.Sprintf(" (%d%%)", row.Reclaimable*100/row.Size)
+			}
+			fmt.Printf("%-15s %-8d %-8d %-10s %s\n", row.Type, row.Total, row.Active, humanSize(row.Size), reclaimable)
+		}
+	},
+}
+
+// humanSize formats bytes with decimal units, like Docker
+func humanSize(bytes int64) string {
+	const unit = 1000
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes)
+	for _, suffix := range []string{"kB", "MB", "GB", "TB"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.3g%s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.3gPB", value/unit)
+}
+
+func init() {
+	systemCmd.AddCommand(systemDFCmd)
+	rootCmd.AddCommand(systemCmd)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var tagCmd = &cobra.Command{
+	Use:   "tag <source> <target>",
+	Short: "Create a tag that refers to the same image as source",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		body, _ := json.Marshal(map[string]string{"source": args[0], "target": args[1]})
+		resp, err := client.Post("http://unix/tag", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			fmt.Println("❌ Failed to connect to daemon:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		io.Copy(os.Stdout, resp.Body)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/vishnucs/pulse-go/internals"
+	"golang.org/x/term"
+)
+
+// terminalSize is the size of the terminal on stdout, or zero if it is not one
+func terminalSize() internals.WindowSize {
+	cols, rows, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return internals.WindowSize{}
+	}
+	return internals.WindowSize{Rows: uint16(rows), Cols: uint16(cols)}
+}
+
+// watchTerminalSize sends the size of this terminal, and again whenever it changes,
+// until stop is called. A receiver that falls behind only gets the latest size.
+func watchTerminalSize() (<-chan internals.WindowSize, func()) {
+	sizes := make(chan internals.WindowSize, 1)
+	sizes <- terminalSize()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-winch:
+				select {
+				case <-sizes:
+				default:
+				}
+				sizes <- terminalSize()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return sizes, func() {
+		signal.Stop(winch)
+		close(done)
+		<-stopped
+		close(sizes)
+	}
+}
+
+// rawTerminal puts the terminal on stdin in raw mode, so every key goes to the
+// container as typed, and returns how to put it back. It does nothing if stdin is
+// not a terminal.
+func rawTerminal() (func(), error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return func() {}, nil
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, err
+	}
+	return func() { term.Restore(fd, state) }, nil
+}
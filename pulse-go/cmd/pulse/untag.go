@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var untagCmd = &cobra.Command{
+	Use:   "untag <image>",
+	Short: "Remove an image reference; layers no other reference uses are cleaned up",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		body, _ := json.Marshal(map[string]string{"image": args[0]})
+		resp, err := client.Post("http://unix/untag", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			fmt.Println("❌ Failed to connect to daemon:", err)
+			return
+		}
+		defer resp.Body.Close()
+
+		io.Copy(os.Stdout, resp.Body)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(untagCmd)
+}
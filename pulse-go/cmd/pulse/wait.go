@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+var waitCmd = &cobra.Command{
+	Use:   "wait <container>...",
+	Short: "Block until containers stop, then print their exit codes",
+	Long: `Block until containers stop, then print their exit codes.
+pulse wait itself exits with the status of the last container: its exit code,
+128+n if signal n killed it, or 1 if it is unknown.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getDaemonClient()
+		if err != nil {
+			fmt.Println("ERROR", err)
+			os.Exit(1)
+		}
+
+		var status internals.ExitStatus
+		for _, ref := range args {
+			resp, err := client.Post("http://unix/containers/"+url.PathEscape(ref)+"/wait", "application/json", nil)
+			if err != nil {
+				fmt.Println("❌ Failed to connect to daemon:", err)
+				os.Exit(1)
+			}
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				fmt.Printf("❌ Daemon error (%d): %s", resp.StatusCode, string(body))
+				os.Exit(1)
+			}
+
+			status = internals.ExitStatus{}
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			resp.Body.Close()
+			if err != nil {
+				fmt.Println("❌ Invalid response from daemon:", err)
+				os.Exit(1)
+			}
+			if status.ExitCode == internals.ExitCodeUnknown {
+				fmt.Println("unknown")
+				continue
+			}
+			fmt.Println(status.ExitCode)
+		}
+		os.Exit(status.Code())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(waitCmd)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+// clientWriteTimeout drops an attached client that stops reading, rather than letting
+// it hold up the container's output
+const clientWriteTimeout = 5 * time.Second
+
+// attachable are the containers this daemon runs, by ID, for /containers/{id}/attach
+var attachable = struct {
+	sync.Mutex
+	ios map[string]*containerIO
+}{ios: map[string]*containerIO{}}
+
+// containerIO connects the stdio of a container the daemon runs to the clients
+// attached to it. Output goes to all of them; input from any of them goes to the
+// container if it was started with open stdin.
+type containerIO struct {
+	container *internals.Container
+	cmd       *exec.Cmd
+	term      *internals.Terminal // nil without a terminal
+	stdin     *os.File            // our end of the input pipe, without a terminal
+	input     io.Writer           // nil if the container takes no input
+	stdout    io.Writer
+
+	mu      sync.Mutex
+	clients map[net.Conn]*internals.StreamWriter
+	status  *internals.ExitStatus // set once the container has exited
+	done    chan struct{}         // closed once wait has finished with the container
+}
+
+// startAttachable starts c with its output going to its log, to out if it is not nil,
+// and to the clients that attach to it
+func startAttachable(c *internals.Container, logs *internals.ContainerLog, out io.Writer) (*containerIO, error) {
+	// The record says exited before the previous run's wait has copied the last of its
+	// output and let go of the container
+	attachable.Lock()
+	previous := attachable.ios[c.ID]
+	attachable.Unlock()
+	if previous != nil {
+		<-previous.done
+	}
+
+	cio := &containerIO{container: c, clients: map[net.Conn]*internals.StreamWriter{}, done: make(chan struct{})}
+
+	stdout := []io.Writer{logs.Stdout(), cio.broadcast(internals.StreamStdout)}
+	stderr := []io.Writer{logs.Stderr(), cio.broadcast(internals.StreamStderr)}
+	if out != nil {
+		stdout = append(stdout, out)
+		stderr = append(stderr, out)
+	}
+	cio.stdout = io.MultiWriter(stdout...)
+
+	var stdin *os.File
+	if c.OpenStdin && !c.Tty {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+		}
+		stdin, cio.stdin, cio.input = r, w, w
+	}
+
+	cmd, term, err := internals.StartContainer(c, readerOrNil(stdin), cio.stdout, io.MultiWriter(stderr...))
+	if stdin != nil {
+		stdin.Close()
+	}
+	if err != nil {
+		if cio.stdin != nil {
+			cio.stdin.Close()
+		}
+		return nil, err
+	}
+	cio.cmd, cio.term = cmd, term
+	if term != nil && c.OpenStdin {
+		cio.input = term
+	}
+
+	attachable.Lock()
+	attachable.ios[c.ID] = cio
+	attachable.Unlock()
+	return cio, nil
+}
+
+// readerOrNil keeps a nil *os.File from becoming a non-nil io.Reader
+func readerOrNil(f *os.File) io.Reader {
+	if f == nil {
+		return nil
+	}
+	return f
+}
+
+// wait waits for the container to exit, copying out what is left of its terminal
+// output, and ends the streams of the clients attached to it with its exit status.
+// The error is WaitContainer's.
+func (cio *containerIO) wait() (internals.ExitStatus, error) {
+	defer close(cio.done)
+	waitProcess := func() error { return internals.WaitContainer(cio.container, cio.cmd) }
+	var err error
+	if cio.term != nil {
+		err = cio.term.Attach(nil, cio.stdout, nil, waitProcess)
+		cio.term.Close()
+	} else {
+		err = waitProcess()
+	}
+	if cio.stdin != nil {
+		cio.stdin.Close()
+	}
+
+	status := internals.ContainerExitStatus(cio.container)
+	if err != nil && status.ExitCode == internals.ExitCodeUnknown {
+		status.Error = err.Error()
+	}
+
+	// A restart may already have registered the container's next run
+	attachable.Lock()
+	if attachable.ios[cio.container.ID] == cio {
+		delete(attachable.ios, cio.container.ID)
+	}
+	attachable.Unlock()
+
+	cio.mu.Lock()
+	defer cio.mu.Unlock()
+	cio.status = &status
+	for conn, stream := range cio.clients {
+		conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		stream.WriteJSON(internals.StreamExit, status)
+		conn.Close()
+	}
+	cio.clients = nil
+	return status, err
+}
+
+// attach adds a client. If the container has already exited, the client only gets
+// the exit status and attach reports false.
+func (cio *containerIO) attach(conn net.Conn) bool {
+	stream := internals.NewStreamWriter(conn)
+	cio.mu.Lock()
+	defer cio.mu.Unlock()
+	if cio.status != nil {
+		stream.WriteJSON(internals.StreamExit, *cio.status)
+		return false
+	}
+	cio.clients[conn] = stream
+	return true
+}
+
+func (cio *containerIO) detach(conn net.Conn) {
+	cio.mu.Lock()
+	delete(cio.clients, conn)
+	cio.mu.Unlock()
+	conn.Close()
+}
+
+// write passes input from a client to the container, if it takes any
+func (cio *containerIO) write(p []byte) {
+	if cio.input != nil {
+		cio.input.Write(p)
+	}
+}
+
+func (cio *containerIO) resize(size internals.WindowSize) {
+	if cio.term != nil {
+		cio.term.Resize(size)
+	}
+}
+
+// broadcast returns a writer whose writes go to every attached client as frames of
+// the given kind. It never fails, so the container's output is never held up.
+func (cio *containerIO) broadcast(kind byte) io.Writer {
+	return broadcastWriter{cio, kind}
+}
+
+type broadcastWriter struct {
+	cio  *containerIO
+	kind byte
+}
+
+func (b broadcastWriter) Write(p []byte) (int, error) {
+	b.cio.mu.Lock()
+	defer b.cio.mu.Unlock()
+	for conn, stream := range b.cio.clients {
+		conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+		if err := stream.WriteFrame(b.kind, p); err != nil {
+			delete(b.cio.clients, conn)
+			conn.Close()
+		}
+	}
+	return len(p), nil
+}
+
+// handleAttachContainer switches the connection to a container stream joined to the
+// stdio of a container this daemon runs, until the container exits or the client
+// goes away. The container keeps running when the client detaches.
+func handleAttachContainer(w http.ResponseWriter, r *http.Request) {
+	container, ok := loadContainerFor(w, r)
+	if !ok {
+		return
+	}
+	if !wantsStream(r) {
+		http.Error(w, "Attaching needs the connection upgraded to "+internals.StreamUpgrade, http.StatusBadRequest)
+		return
+	}
+
+	attachable.Lock()
+	cio := attachable.ios[container.ID]
+	attachable.Unlock()
+	if cio == nil {
+		if container.State == internals.StateRunning {
+			http.Error(w, fmt.Sprintf("container %s was not started by this daemon; see pulse logs", container.Name), http.StatusConflict)
+		} else {
+			http.Error(w, fmt.Sprintf("container %s is not running", container.Name), http.StatusConflict)
+		}
+		return
+	}
+
+	// The client puts its terminal in raw mode only if the container has one too
+	w.Header().Set("Pulse-Tty", strconv.FormatBool(container.Tty))
+	conn, frames, err := upgradeStream(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !cio.attach(conn) {
+		conn.Close()
+		return
+	}
+	defer cio.detach(conn)
+
+	readClientFrames(frames, cio.write, cio.resize)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+// busyContainers are being started, restarted or removed; a second such request for
+// the same container is refused rather than racing the first
+var busyContainers = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+// claimContainer marks a container busy until the returned function is called, or
+// reports false if it already is
+func claimContainer(id string) (func(), bool) {
+	busyContainers.Lock()
+	defer busyContainers.Unlock()
+	if busyContainers.ids[id] {
+		return nil, false
+	}
+	busyContainers.ids[id] = true
+	return func() {
+		busyContainers.Lock()
+		delete(busyContainers.ids, id)
+		busyContainers.Unlock()
+	}, true
+}
+
+// startDetached starts a container with its output going to its log and to the
+// clients attached to it, and reaps it in the background so it outlives the request
+func startDetached(c *internals.Container) error {
+	logs, err := internals.OpenContainerLog(c)
+	if err != nil {
+		return err
+	}
+	cio, err := startAttachable(c, logs, nil)
+	if err != nil {
+		logs.Close()
+		return err
+	}
+
+	go func() {
+		cio.wait()
+		logs.Close()
+	}()
+	return nil
+}
+
+// stopTimeout reads the ?time= seconds a stop waits before SIGKILL
+func stopTimeout(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("time")
+	if value == "" {
+		return internals.DefaultStopTimeout, nil
+	}
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs < 0 {
+		return 0, fmt.Errorf("invalid time parameter %q", value)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+func writeContainerResult(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	result := "success"
+	if status != http.StatusOK {
+		result = "error"
+		w.WriteHeader(status)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  result,
+		"message": message,
+	})
+}
+
+// loadContainerFor loads the container of a lifecycle request, answering it if that fails
+func loadContainerFor(w http.ResponseWriter, r *http.Request) (*internals.Container, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	container, err := internals.LoadContainer(r.PathValue("id"))
+	if err != nil {
+		writeContainerResult(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	return container, true
+}
+
+// handleStopContainer sends SIGTERM, then SIGKILL after ?time= seconds
+func handleStopContainer(w http.ResponseWriter, r *http.Request) {
+	container, ok := loadContainerFor(w, r)
+	if !ok {
+		return
+	}
+	timeout, err := stopTimeout(r)
+	if err != nil {
+		writeContainerResult(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if container.State != internals.StateRunning {
+		writeContainerResult(w, http.StatusOK, fmt.Sprintf("Container %s is not running", container.Name))
+		return
+	}
+	if err := internals.StopContainer(container, timeout); err != nil {
+		writeContainerResult(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeContainerResult(w, http.StatusOK, fmt.Sprintf("🛑 Stopped container %s", container.Name))
+}
+
+// handleKillContainer sends ?signal= (SIGKILL by default) to the container's process
+func handleKillContainer(w http.ResponseWriter, r *http.Request) {
+	container, ok := loadContainerFor(w, r)
+	if !ok {
+		return
+	}
+	sig := syscall.SIGKILL
+	if name := r.URL.Query().Get("signal"); name != "" {
+		parsed, err := internals.ParseSignal(name)
+		if err != nil {
+			writeContainerResult(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		sig = parsed
+	}
+
+	if container.State != internals.StateRunning {
+		writeContainerResult(w, http.StatusConflict, fmt.Sprintf("container %s is not running", container.Name))
+		return
+	}
+	if err := internals.KillContainer(container, sig); err != nil {
+		writeContainerResult(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeContainerResult(w, http.StatusOK, fmt.Sprintf("⚡ Sent %s to container %s", internals.SignalName(sig), container.Name))
+}
+
+// handleStartContainer starts a created or exited container again, in the background,
+// on its existing rootfs layer and with its recorded configuration
+func handleStartContainer(w http.ResponseWriter, r *http.Request) {
+	container, ok := loadContainerFor(w, r)
+	if !ok {
+		return
+	}
+	release, ok := claimContainer(container.ID)
+	if !ok {
+		writeContainerResult(w, http.StatusConflict, fmt.Sprintf("container %s is busy", container.Name))
+		return
+	}
+	defer release()
+
+	if container.State == internals.StateRunning {
+		writeContainerResult(w, http.StatusOK, fmt.Sprintf("Container %s is already running", container.Name))
+		return
+	}
+	if err := startDetached(container); err != nil {
+		writeContainerResult(w, http.StatusInternalServerError, fmt.Sprintf("failed to start container %s: %v", container.Name, err))
+		return
+	}
+	writeContainerResult(w, http.StatusOK, fmt.Sprintf("🚀 Started container %s", container.Name))
+}
+
+// handleRestartContainer stops the container like handleStopContainer, if it runs, and
+// starts it again
+func handleRestartContainer(w http.ResponseWriter, r *http.Request) {
+	container, ok := loadContainerFor(w, r)
+	if !ok {
+		return
+	}
+	timeout, err := stopTimeout(r)
+	if err != nil {
+		writeContainerResult(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	release, ok := claimContainer(container.ID)
+	if !ok {
+		writeContainerResult(w, http.StatusConflict, fmt.Sprintf("container %s is busy", container.Name))
+		return
+	}
+	defer release()
+
+	if err := internals.StopContainer(container, timeout); err != nil {
+		writeContainerResult(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if err := startDetached(container); err != nil {
+		writeContainerResult(w, http.StatusInternalServerError, fmt.Sprintf("failed to start container %s: %v", container.Name, err))
+		return
+	}
+	writeContainerResult(w, http.StatusOK, fmt.Sprintf("🔄 Restarted container %s", container.Name))
+}
+
+// handleWaitContainer blocks until the container is not running and returns its exit
+// code, -1 if it is unknown, and the signal that killed it. The wait ends if the
+// client goes away.
+func handleWaitContainer(w http.ResponseWriter, r *http.Request) {
+	container, ok := loadContainerFor(w, r)
+	if !ok {
+		return
+	}
+
+	final, err := internals.WaitContainerExit(r.Context(), container)
+	if err != nil {
+		writeContainerResult(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":    "success",
+		"exit_code": final.ExitCode,
+		"signal":    final.Signal,
+	})
+}
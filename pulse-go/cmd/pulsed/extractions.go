@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+// extraction is an image being extracted; requests for the same image and platform
+// wait for it and share its rootfs
+type extraction struct {
+	done   chan struct{}
+	rootfs string
+	err    error
+}
+
+var extractions = struct {
+	sync.Mutex
+	byKey map[string]*extraction
+}{byKey: map[string]*extraction{}}
+
+// extractShared extracts the image, or waits for the extraction already in progress.
+// joined says whether another request started it.
+func extractShared(image, platform string) (rootfs string, joined bool, err error) {
+	key := imageKey(image, platform)
+
+	extractions.Lock()
+	e, joined := extractions.byKey[key]
+	if !joined {
+		e = &extraction{done: make(chan struct{})}
+		extractions.byKey[key] = e
+	}
+	extractions.Unlock()
+
+	if !joined {
+		e.rootfs, e.err = internals.Extract(image, platform)
+		extractions.Lock()
+		delete(extractions.byKey, key)
+		extractions.Unlock()
+		close(e.done)
+	}
+	<-e.done
+	return e.rootfs, joined, e.err
+}
@@ -1,31 +1,63 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vishnucs/pulse-go/internals"
 )
 
 type PullRequest struct {
-	Image string `json:"image"`
+	Image    string `json:"image"`
+	Platform string `json:"platform"` // empty selects the daemon's platform
+	Always   bool   `json:"always"`   // re-resolve the tag even if the image is local
 }
 
 type RemoveRequest struct {
 	Image string `json:"image"`
+	Force bool   `json:"force"` // stop containers using the image instead of refusing
+}
+
+type TagRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type PruneRequest struct {
+	All     bool     `json:"all"`
+	Filters []string `json:"filters"`
 }
 
 type RunRequest struct {
-	Image       string   `json:"image"`
-	Cmd         []string `json:"cmd"`
-	Env         []string `json:"env"`
-	Network     bool     `json:"network"`
-	Interactive bool     `json:"interactive"`
+	Image       string    `json:"image"`
+	Platform    string    `json:"platform"`
+	Name        string    `json:"name"`
+	Cmd         []string  `json:"cmd"`
+	Entrypoint  *[]string `json:"entrypoint"` // nil keeps the image Entrypoint
+	Env         []string  `json:"env"`
+	WorkingDir  string    `json:"workdir"`
+	User        string    `json:"user"`
+	Network     bool      `json:"network"`
+	Interactive bool      `json:"interactive"`
+	Detach      bool      `json:"detach"`
+	Tty         bool      `json:"tty"` // streamed over an upgraded connection unless detached
+}
+
+type ExecRequest struct {
+	Cmd        []string `json:"cmd"`
+	Env        []string `json:"env"`
+	User       string   `json:"user"`    // empty keeps the container's user
+	WorkingDir string   `json:"workdir"` // empty keeps the container's working directory
+	Tty        bool     `json:"tty"`     // streamed over an upgraded connection
 }
 
 func handlePull(w http.ResponseWriter, r *http.Request) {
@@ -34,48 +66,125 @@ func handlePull(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Cache-Control", "no-cache")
 
 	var req PullRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	cred, err := callerCredentials(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	caller, err := internals.LookupUser(cred.Uid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
-	image := req.Image
-	fmt.Fprintf(w, "Starting pull for %s...\n", image)
-	flusher.Flush()
+	// A pull of the same image already in progress is joined rather than repeated
+	pull, err := joinPull(req, cred.Uid, internals.PullOptions{
+		Platform: req.Platform,
+		Always:   req.Always,
+		User:     caller,
 
-	_, err := internals.PullImage(image, w, flusher)
+		RequirePolicy: strictPolicy,
+	})
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	flusher.Flush()
+
+	// Progress is streamed as one JSON event per line; a failure is the last event.
+	// The pull stops when every client waiting on it has gone away, or when
+	// DELETE /pulls/<id> cancels it.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Pulse-Pull-ID", pull.id)
+	encoder := json.NewEncoder(w)
+	pull.follow(r.Context(), func(event internals.PullEvent) {
+		encoder.Encode(event)
+		flusher.Flush()
+	})
 }
 
 func handleListImages(w http.ResponseWriter, r *http.Request) {
-	imagesDir := filepath.Join(os.Getenv("HOME"), ".pulse", "images")
-
-	files, err := os.ReadDir(imagesDir)
+	images, err := internals.ListImages()
 	if err != nil {
 		http.Error(w, "failed to read images directory\n", http.StatusInternalServerError)
 		return
 	}
+	if images == nil {
+		images = []internals.ImageSummary{}
+	}
 
-	var imageList []map[string]string
-	for _, f := range files {
-		if f.IsDir() {
-			info, _ := f.Info()
-			imageList = append(imageList, map[string]string{
-				"name":     f.Name(),
-				"modified": info.ModTime().Format(time.RFC822),
-			})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+func handleTag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := internals.TagImage(req.Source, req.Target); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
 		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("🏷️ Tagged %s as %s", req.Source, req.Target),
+	})
+}
+
+func handleUntag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RemoveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(imageList)
+	if err := internals.UntagImage(req.Image); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("🏷️ Untagged: %s", req.Image),
+	})
 }
 
 func handleRemove(w http.ResponseWriter, r *http.Request) {
@@ -91,8 +200,27 @@ func handleRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg, err := internals.RemoveImage(image)
+	msg, err := internals.RemoveImage(image, req.Force)
 	w.Header().Set("Content-Type", "application/json")
+
+	var inUse *internals.ImageInUseError
+	if errors.As(err, &inUse) {
+		var blocking []map[string]string
+		for _, c := range inUse.Containers {
+			blocking = append(blocking, map[string]string{
+				"id":    c.ID,
+				"name":  c.Name,
+				"state": c.State,
+			})
+		}
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":     "error",
+			"message":    err.Error(),
+			"containers": blocking,
+		})
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -119,31 +247,410 @@ func handleRun(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
 		return
 	}
-
-	// Validate command
-	if len(req.Cmd) == 0 {
-		req.Cmd = []string{"/bin/sh"}
+	// A terminal's output can only be sent once the connection is switched over
+	attachTerminal := req.Tty && !req.Detach
+	if attachTerminal && !wantsStream(r) {
+		http.Error(w, "A terminal needs the connection upgraded to "+internals.StreamUpgrade, http.StatusBadRequest)
+		return
+	}
+	quiet := req.Detach || attachTerminal
+	if !quiet {
+		// The JSON ExitStatus of the container follows its output
+		w.Header().Set("Trailer", "Pulse-Exit-Status")
 	}
 
 	// Extract the image
-	fmt.Fprintf(w, "📦 Extracting image %s...\n", req.Image)
-	w.(http.Flusher).Flush()
+	if !quiet {
+		fmt.Fprintf(w, "📦 Extracting image %s...\n", req.Image)
+		w.(http.Flusher).Flush()
+	}
 
-	rootfs, err := internals.Extract(req.Image)
+	rootfs, joined, err := extractShared(req.Image, req.Platform)
+	if joined && !quiet {
+		fmt.Fprintf(w, "📦 Shared the extraction of %s already in progress\n", req.Image)
+	}
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to extract image: %v", err), http.StatusInternalServerError)
+		runFailed(w, quiet, fmt.Sprintf("Failed to extract image: %v", err))
+		return
+	}
+
+	overrides := internals.RunOverrides{
+		Cmd:        req.Cmd,
+		Env:        req.Env,
+		WorkingDir: req.WorkingDir,
+		User:       req.User,
+	}
+	if req.Entrypoint != nil {
+		overrides.Entrypoint = *req.Entrypoint
+		overrides.EntrypointSet = true
+	}
+
+	config, err := internals.ResolveRunConfig(req.Image, req.Platform, overrides)
+	if err != nil {
+		runFailed(w, quiet, fmt.Sprintf("Failed to read image config: %v", err))
+		return
+	}
+
+	container, err := internals.NewContainer(req.Name, req.Image, rootfs, config, req.Network)
+	if err != nil {
+		runFailed(w, quiet, fmt.Sprintf("Failed to create container: %v", err))
+		return
+	}
+	container.Tty = req.Tty
+	container.OpenStdin = req.Interactive
+
+	if req.Detach {
+		// Output only goes to the log file so the container outlives this request
+		if err := startDetached(container); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to start container: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, container.ID)
+		return
+	}
+
+	logs, err := internals.OpenContainerLog(container)
+	if err != nil {
+		runFailed(w, quiet, err.Error())
+		return
+	}
+
+	if attachTerminal {
+		runTerminal(w, r, container, logs)
 		return
 	}
 
 	fmt.Fprintf(w, "✅ Image extracted to %s\n", rootfs)
-	fmt.Fprintf(w, "🚀 Starting container...\n\n")
+	fmt.Fprintf(w, "🚀 Starting container %s (%s)...\n\n", container.Name, internals.ShortID(container.ID))
 	w.(http.Flusher).Flush()
 
-	// Run the container with interactive flag
-	if err := internals.RunContainer(rootfs, req.Cmd, req.Env, req.Network, req.Interactive); err != nil {
-		fmt.Fprintf(w, "\n❌ Container failed: %v\n", err)
+	// Output is streamed to the client and kept in the log at the same time
+	out := &flushWriter{w: w, flusher: w.(http.Flusher)}
+	var status internals.ExitStatus
+	if cio, err := startAttachable(container, logs, out); err != nil {
+		status = internals.ExitStatus{ExitCode: internals.ExitCodeUnknown, Error: err.Error()}
+	} else {
+		status, _ = cio.wait()
+	}
+	logs.Close()
+	writeExitStatus(w, status)
+}
+
+// writeExitStatus ends a run's output with the container's exit status, as text and as
+// the Pulse-Exit-Status trailer
+func writeExitStatus(w http.ResponseWriter, status internals.ExitStatus) {
+	fmt.Fprintf(w, "\n%s\n", status)
+	trailer, _ := json.Marshal(status)
+	w.Header().Set("Pulse-Exit-Status", string(trailer))
+}
+
+// runFailed reports a run that failed before its container ran. Unless the run is quiet
+// the 200 response has already begun, so the error is reported like a container that
+// failed to start: in the output and the exit status trailer.
+func runFailed(w http.ResponseWriter, quiet bool, message string) {
+	if quiet {
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	writeExitStatus(w, internals.ExitStatus{ExitCode: internals.ExitCodeUnknown, Error: message})
+}
+
+// runTerminal runs a container with a terminal over the request's upgraded connection:
+// its output goes to the client (and the log) in stdout frames, the client sends what
+// is typed and the size of its terminal, and the exit status ends the stream. The
+// container keeps running if the client goes away.
+func runTerminal(w http.ResponseWriter, r *http.Request, container *internals.Container, logs *internals.ContainerLog) {
+	defer logs.Close()
+	conn, frames, err := upgradeStream(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	stream := internals.NewStreamWriter(conn)
+	out := &flushWriter{w: stream.Stream(internals.StreamStdout)}
+	fmt.Fprintf(out, "🚀 Starting container %s (%s)...\n\n", container.Name, internals.ShortID(container.ID))
+
+	cio, err := startAttachable(container, logs, out)
+	if err != nil {
+		stream.WriteJSON(internals.StreamExit, internals.ExitStatus{ExitCode: internals.ExitCodeUnknown, Error: err.Error()})
+		return
+	}
+
+	// The client drives the terminal whether or not it stays open to attach (-i)
+	go readClientFrames(frames, func(p []byte) { cio.term.Write(p) }, cio.resize)
+	status, _ := cio.wait()
+	stream.WriteJSON(internals.StreamExit, status)
+}
+
+// flushWriter pushes container output to the client as it is produced. Write errors
+// (client gone) are swallowed so a disconnect never kills the container with SIGPIPE.
+// Writers that need no flushing leave flusher nil. One flushWriter takes both stdout
+// and stderr, which are copied by goroutines of their own, so writes are serialized.
+type flushWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if _, err := fw.w.Write(p); err == nil && fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+	return len(p), nil
+}
+
+// handleExec runs a command in a running container and streams its output. The exit
+// code follows the output as the Pulse-Exit-Code trailer.
+func handleExec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	fmt.Fprintf(w, "\n✅ Container exited successfully\n")
+	container, err := internals.LoadContainer(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var req ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if container.State != internals.StateRunning {
+		http.Error(w, fmt.Sprintf("container %s is not running", container.Name), http.StatusConflict)
+		return
+	}
+	opts := internals.ExecOptions{
+		Cmd:        req.Cmd,
+		Env:        req.Env,
+		User:       req.User,
+		WorkingDir: req.WorkingDir,
+	}
+
+	if req.Tty {
+		if !wantsStream(r) {
+			http.Error(w, "A terminal needs the connection upgraded to "+internals.StreamUpgrade, http.StatusBadRequest)
+			return
+		}
+		execTerminal(w, r, container, opts)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Trailer", "Pulse-Exit-Code")
+	w.WriteHeader(http.StatusOK)
+
+	// The command is killed if the client goes away
+	out := &flushWriter{w: w, flusher: w.(http.Flusher)}
+	code, err := internals.ExecContainer(r.Context(), container, opts, nil, out, out)
+	if err != nil {
+		fmt.Fprintf(w, "❌ Exec failed: %v\n", err)
+		return
+	}
+	w.Header().Set("Pulse-Exit-Code", strconv.Itoa(code))
+}
+
+// execTerminal runs an exec with a terminal over the request's upgraded connection,
+// like runTerminal, with what the client types as the terminal's input. Once the
+// connection is hijacked its context no longer ends with it, so the command is killed
+// when the client's frames stop.
+func execTerminal(w http.ResponseWriter, r *http.Request, container *internals.Container, opts internals.ExecOptions) {
+	conn, frames, err := upgradeStream(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sizes := make(chan internals.WindowSize, 1)
+	// Closing stdin once the command is done frees a frame reader blocked on input
+	stdin, input := io.Pipe()
+	defer stdin.Close()
+	go func() {
+		readClientFrames(frames, func(p []byte) { input.Write(p) }, func(size internals.WindowSize) { latestSize(sizes, size) })
+		input.Close()
+		cancel()
+	}()
+
+	stream := internals.NewStreamWriter(conn)
+	opts.Tty = true
+	opts.Resize = sizes
+	code, err := internals.ExecContainer(ctx, container, opts, stdin, stream.Stream(internals.StreamStdout), nil)
+
+	status := internals.ExitStatus{ExitCode: code}
+	if err != nil {
+		status.ExitCode = internals.ExitCodeUnknown
+		status.Error = err.Error()
+	}
+	stream.WriteJSON(internals.StreamExit, status)
+}
+
+func handleListContainers(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") == "1"
+
+	containers, err := internals.ListContainers(all)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list containers: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if containers == nil {
+		containers = []*internals.Container{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(containers)
+}
+
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	container, err := internals.LoadContainer(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := internals.LogOptions{
+		Follow: query.Get("follow") == "1",
+		Tail:   -1,
+	}
+	if tail := query.Get("tail"); tail != "" && tail != "all" {
+		n, err := strconv.Atoi(tail)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid tail parameter", http.StatusBadRequest)
+			return
+		}
+		opts.Tail = n
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		opts.Since = t
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if err := internals.ReadContainerLogs(r.Context(), container, opts, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleRemoveContainer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	container, err := internals.LoadContainer(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	release, ok := claimContainer(container.ID)
+	if !ok {
+		writeContainerResult(w, http.StatusConflict, fmt.Sprintf("container %s is busy", container.Name))
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("force") == "1" {
+		if err := internals.StopContainer(container, internals.DefaultStopTimeout); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	if err := internals.RemoveContainer(container); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": fmt.Sprintf("🗑️ Successfully removed container: %s", container.Name),
+	})
+}
+
+func handlePruneImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PruneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	filters, err := internals.ParsePruneFilters(req.Filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := internals.PruneImages(req.All, filters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prune images: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func handlePruneContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PruneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	filters, err := internals.ParsePruneFilters(req.Filters)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := internals.PruneContainers(filters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prune containers: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func handleSystemDF(w http.ResponseWriter, r *http.Request) {
+	usage, err := internals.SystemDiskUsage()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to compute disk usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
 }
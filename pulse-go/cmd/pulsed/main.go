@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/vishnucs/pulse-go/internals"
 )
 
+// strictPolicy makes pulls fail rather than skip verification when the policy is gone
+var strictPolicy bool
+
 func main() {
 	// Check if we're being called as a child process
 	if len(os.Args) > 1 && os.Args[1] == "child" {
@@ -21,6 +28,31 @@ func main() {
 		return
 	}
 
+	flag.BoolVar(&strictPolicy, "strict", false, "Refuse to start without a signature policy, and never pull unverified images")
+	flag.Parse()
+
+	_, err := internals.LoadSignaturePolicy()
+	switch {
+	case err != nil && strictPolicy:
+		fmt.Fprintf(os.Stderr, "❌ Strict mode requires a valid signature policy: %v\n", err)
+		os.Exit(1)
+	case errors.Is(err, internals.ErrNoSignaturePolicy):
+		fmt.Printf("⚠️ %v; images will be pulled without signature verification\n", err)
+	case err != nil:
+		fmt.Printf("⚠️ %v; pulls will fail until it is fixed\n", err)
+	case strictPolicy:
+		fmt.Println("🔏 Strict mode: every pull is checked against the signature policy")
+	}
+
+	// Once per store, before any request can read it
+	notes, err := internals.MigrateImageStore()
+	for _, note := range notes {
+		fmt.Println("📦 Image store:", note)
+	}
+	if err != nil {
+		fmt.Printf("⚠️ %v; images pulled by older versions of pulse may be missing\n", err)
+	}
+
 	socketPath := "/tmp/pulse.sock"
 	os.Remove(socketPath)
 
@@ -39,11 +71,27 @@ func main() {
 		fmt.Fprintln(w, "Pulse Daemon is healthy ✅")
 	})
 	mux.HandleFunc("/pull", handlePull)
+	mux.HandleFunc("/pulls/{id}", handleCancelPull)
 	mux.HandleFunc("/images", handleListImages)
+	mux.HandleFunc("/images/prune", handlePruneImages)
 	mux.HandleFunc("/remove", handleRemove)
+	mux.HandleFunc("/tag", handleTag)
+	mux.HandleFunc("/untag", handleUntag)
 	mux.HandleFunc("/run", handleRun)
+	mux.HandleFunc("/containers", handleListContainers)
+	mux.HandleFunc("/containers/prune", handlePruneContainers)
+	mux.HandleFunc("/containers/{id}", handleRemoveContainer)
+	mux.HandleFunc("/containers/{id}/logs", handleLogs)
+	mux.HandleFunc("/containers/{id}/exec", handleExec)
+	mux.HandleFunc("/containers/{id}/start", handleStartContainer)
+	mux.HandleFunc("/containers/{id}/stop", handleStopContainer)
+	mux.HandleFunc("/containers/{id}/restart", handleRestartContainer)
+	mux.HandleFunc("/containers/{id}/kill", handleKillContainer)
+	mux.HandleFunc("/containers/{id}/wait", handleWaitContainer)
+	mux.HandleFunc("/containers/{id}/attach", handleAttachContainer)
+	mux.HandleFunc("/system/df", handleSystemDF)
 
-	server := &http.Server{Handler: mux}
+	server := &http.Server{Handler: mux, ConnContext: withPeerCredentials}
 
 	// Graceful shutdown when Ctrl+C or SIGTERM
 	stop := make(chan os.Signal, 1)
@@ -59,7 +107,42 @@ func main() {
 
 	<-stop
 	fmt.Println("\n🛑 Shutting down Pulse Daemon...")
+	// Cancelled pulls remove their partial downloads before the daemon goes
+	cancelPulls(10 * time.Second)
 	server.Close()
 	os.Remove(socketPath)
 	fmt.Println("✅ Clean exit.")
 }
+
+type peerKey struct{}
+
+// withPeerCredentials records who is on the other end of the socket, so requests use
+// the caller's registry credentials rather than the daemon's
+func withPeerCredentials(ctx context.Context, c net.Conn) context.Context {
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerKey{}, cred)
+}
+
+// callerCredentials returns the credentials of the process that sent r
+func callerCredentials(r *http.Request) (*syscall.Ucred, error) {
+	cred, ok := r.Context().Value(peerKey{}).(*syscall.Ucred)
+	if !ok {
+		return nil, errors.New("cannot identify the calling user")
+	}
+	return cred, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+// pullFlight is a pull in progress. Requests of the same user for the same image and
+// platform while it runs join it instead of pulling again, and every one of them is
+// sent all of its events. It is cancelled when the last of them goes away, or by DELETE /pulls/<id>.
+type pullFlight struct {
+	id     string
+	key    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	events  []internals.PullEvent
+	changed chan struct{} // closed and replaced on every event
+	done    bool
+	uids    map[uint32]bool // users who asked for the pull, and may cancel it
+	waiters int
+}
+
+// pulls are the pulls in progress by ID and by what they pull
+var pulls = struct {
+	sync.Mutex
+	byID  map[string]*pullFlight
+	byKey map[string]*pullFlight
+	wg    sync.WaitGroup
+}{byID: map[string]*pullFlight{}, byKey: map[string]*pullFlight{}}
+
+// imageKey identifies an image and platform however they are spelt
+func imageKey(image, platform string) string {
+	if name, err := internals.NormalizeImage(image); err == nil {
+		image = name
+	}
+	if p, err := internals.ParsePlatform(platform); err == nil {
+		platform = p.String()
+	}
+	return image + " " + platform
+}
+
+// pullKey identifies pulls that would do the same work. Pulls run with the caller's
+// registry credentials, so only pulls of the same user are shared: another user must
+// not get an image their own credentials (or lack of them) would not have pulled.
+func pullKey(req PullRequest, uid uint32) string {
+	key := fmt.Sprintf("%s uid=%d", imageKey(req.Image, req.Platform), uid)
+	if req.Always {
+		key += " always"
+	}
+	return key
+}
+
+// joinPull returns uid's pull in progress for req, or starts one with opts. Either way
+// uid may cancel it.
+func joinPull(req PullRequest, uid uint32, opts internals.PullOptions) (*pullFlight, error) {
+	key := pullKey(req, uid)
+
+	pulls.Lock()
+	defer pulls.Unlock()
+	// A pull that everyone left is still cleaning up; it is not worth joining
+	if f, ok := pulls.byKey[key]; ok && f.ctx.Err() == nil {
+		f.mu.Lock()
+		f.uids[uid] = true
+		f.waiters++
+		f.mu.Unlock()
+		return f, nil
+	}
+
+	var id [6]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &pullFlight{
+		id:      hex.EncodeToString(id[:]),
+		key:     key,
+		ctx:     ctx,
+		cancel:  cancel,
+		changed: make(chan struct{}),
+		uids:    map[uint32]bool{uid: true},
+		waiters: 1,
+	}
+	pulls.byID[f.id] = f
+	pulls.byKey[key] = f
+	pulls.wg.Add(1)
+
+	go func() {
+		defer pulls.wg.Done()
+		internals.PullImage(ctx, req.Image, opts, f.publish)
+		f.finish()
+	}()
+	return f, nil
+}
+
+func (f *pullFlight) publish(event internals.PullEvent) {
+	if event.Status == internals.PullStatusPulling {
+		event.Pull = f.id
+	}
+	f.mu.Lock()
+	f.events = append(f.events, event)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.mu.Unlock()
+}
+
+// finish makes the pull's events final; requests arriving later start a new pull
+func (f *pullFlight) finish() {
+	pulls.Lock()
+	delete(pulls.byID, f.id)
+	if pulls.byKey[f.key] == f {
+		delete(pulls.byKey, f.key)
+	}
+	pulls.Unlock()
+
+	f.mu.Lock()
+	f.done = true
+	close(f.changed)
+	f.mu.Unlock()
+	f.cancel()
+}
+
+// follow sends every event of the pull, from the first, until the pull ends or ctx
+// does. A follower leaving early no longer holds the pull up.
+func (f *pullFlight) follow(ctx context.Context, send func(internals.PullEvent)) {
+	for next := 0; ; {
+		f.mu.Lock()
+		events, done, changed := f.events[next:], f.done, f.changed
+		f.mu.Unlock()
+
+		for _, event := range events {
+			send(event)
+		}
+		next += len(events)
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			f.leave()
+			return
+		}
+	}
+}
+
+func (f *pullFlight) leave() {
+	f.mu.Lock()
+	f.waiters--
+	last := f.waiters == 0 && !f.done
+	f.mu.Unlock()
+	if last {
+		f.cancel()
+	}
+}
+
+// cancelPulls cancels every pull and waits up to timeout for them to clean up
+func cancelPulls(timeout time.Duration) {
+	pulls.Lock()
+	for _, f := range pulls.byID {
+		f.cancel()
+	}
+	pulls.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pulls.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// handleCancelPull cancels a pull for everyone waiting on it. Only root and the users
+// who asked for it may; the pull's streams end with a cancelled error event.
+func handleCancelPull(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cred, err := callerCredentials(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	id := r.PathValue("id")
+	pulls.Lock()
+	f, ok := pulls.byID[id]
+	pulls.Unlock()
+	if !ok {
+		http.Error(w, "no such pull: "+id, http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	allowed := cred.Uid == 0 || f.uids[cred.Uid]
+	f.mu.Unlock()
+	if !allowed {
+		http.Error(w, "pull "+id+" belongs to another user", http.StatusForbidden)
+		return
+	}
+
+	f.cancel()
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "🛑 Cancelled pull " + id,
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vishnucs/pulse-go/internals"
+)
+
+// wantsStream reports whether the client asked for its connection to become a
+// container stream
+func wantsStream(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), internals.StreamUpgrade)
+}
+
+// upgradeStream answers r with 101 Switching Protocols, and the headers set on w, and
+// hands over the connection and the frames the client sends on it
+func upgradeStream(w http.ResponseWriter, r *http.Request) (net.Conn, io.Reader, error) {
+	// Frames follow the request body; what the handler left of it must not be read as one
+	io.Copy(io.Discard, r.Body)
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n", internals.StreamUpgrade)
+	w.Header().Write(buf)
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, buf.Reader, nil
+}
+
+// readClientFrames passes the input the client sends to input, unless it is nil, and
+// the sizes of its terminal to resize, until the client goes away
+func readClientFrames(frames io.Reader, input func([]byte), resize func(internals.WindowSize)) {
+	for {
+		kind, payload, err := internals.ReadFrame(frames)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case internals.StreamStdin:
+			if input != nil {
+				input(payload)
+			}
+		case internals.StreamResize:
+			var size internals.WindowSize
+			if json.Unmarshal(payload, &size) == nil {
+				resize(size)
+			}
+		}
+	}
+}
+
+// latestSize queues size on sizes, replacing a size not taken yet. There must be a
+// single sender.
+func latestSize(sizes chan internals.WindowSize, size internals.WindowSize) {
+	select {
+	case <-sizes:
+	default:
+	}
+	sizes <- size
+}
@@ -1,21 +1,153 @@
 package internals
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-func RemoveImage(image string) (string, error) {
-	imageDir := filepath.Join(getImagesDir(), fmt.Sprintf("%s-oci", sanitize(image)))
+// ImageInUseError is returned when containers still reference the image being removed
+type ImageInUseError struct {
+	Image      string
+	Containers []*Container
+}
+
+func (e *ImageInUseError) Error() string {
+	var names []string
+	for _, c := range e.Containers {
+		names = append(names, fmt.Sprintf("%s (%s, %s)", c.Name, ShortID(c.ID), c.State))
+	}
+	return fmt.Sprintf("❌ image %s is in use by %s", e.Image, strings.Join(names, ", "))
+}
+
+// ImageUsers returns the containers, running or not, that were created from image
+func ImageUsers(image string) ([]*Container, error) {
+	record, err := loadImageRecord(image)
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+
+	rootfs := imageRootfsPaths(record)
+	var users []*Container
+	for _, c := range containers {
+		if usesImage(c, record, rootfs) {
+			users = append(users, c)
+		}
+	}
+	return users, nil
+}
+
+// imageRootfsPaths returns the layer snapshots the image's manifests extract to
+func imageRootfsPaths(record *ImageRecord) map[string]bool {
+	paths := map[string]bool{}
+	for _, m := range record.Manifests {
+		data, err := readBlob(m.Digest)
+		if err != nil {
+			continue
+		}
+		var manifest OCIManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			continue
+		}
+		config, err := readImageConfig(&manifest)
+		if err != nil {
+			continue
+		}
+		chain, err := chainIDs(config.RootFS.DiffIDs)
+		if err != nil || len(chain) == 0 {
+			continue
+		}
+		paths[snapshotPath(chain[len(chain)-1])] = true
+	}
+	return paths
+}
+
+// usesImage matches containers by the layers they run on, so a container follows its
+// image across tags and keeps no claim on a tag that was since pulled again. Containers
+// from before layer snapshots are matched by name.
+func usesImage(c *Container, record *ImageRecord, rootfs map[string]bool) bool {
+	if rootfs[c.ImageRootfs] {
+		return true
+	}
+	if filepath.Dir(c.ImageRootfs) == filepath.Join(getLayersDir(), "sha256") {
+		return false
+	}
+	name, err := NormalizeImage(c.Image)
+	return err == nil && name == record.Name
+}
 
-	if _, err := os.Stat(imageDir); os.IsNotExist(err) {
-		return "", fmt.Errorf("❌ image %s not found locally", image)
+// referencedElsewhere reports whether other references keep all of the record's manifests
+func referencedElsewhere(record *ImageRecord) bool {
+	records, err := ListImageRecords()
+	if err != nil {
+		return false
 	}
 
-	if err := os.RemoveAll(imageDir); err != nil {
+	others := map[string]bool{}
+	for _, other := range records {
+		if other.Name == record.Name {
+			continue
+		}
+		for _, m := range other.Manifests {
+			others[m.Digest] = true
+		}
+	}
+	for _, m := range record.Manifests {
+		if !others[m.Digest] {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveImage drops the image's reference and garbage-collects the blobs and layer
+// snapshots that no other image or container uses. When other tags still refer to the
+// same manifests only the reference goes. Otherwise an image that containers were
+// created from is only removed with force, which stops the running ones first;
+// stopped containers keep their layers and can still be started.
+func RemoveImage(image string, force bool) (string, error) {
+	record, err := loadImageRecord(image)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("❌ image %s not found locally", image)
+		}
+		return "", fmt.Errorf("❌ failed to remove image %s: %v", image, err)
+	}
+
+	if referencedElsewhere(record) {
+		if err := removeImageRecord(image); err != nil {
+			return "", fmt.Errorf("❌ failed to untag %s: %v", image, err)
+		}
+		return fmt.Sprintf("🏷️ Untagged: %s", FamiliarImage(record.Name)), nil
+	}
+
+	users, err := ImageUsers(image)
+	if err != nil {
+		return "", fmt.Errorf("❌ failed to remove image %s: %v", image, err)
+	}
+	if len(users) > 0 && !force {
+		return "", &ImageInUseError{Image: image, Containers: users}
+	}
+	for _, c := range users {
+		if err := StopContainer(c, DefaultStopTimeout); err != nil {
+			return "", fmt.Errorf("❌ failed to remove image %s: %v", image, err)
+		}
+	}
+
+	if err := removeImageRecord(image); err != nil {
 		return "", fmt.Errorf("❌ failed to remove image %s: %v", image, err)
 	}
 
+	if _, err := CollectGarbage(); err != nil {
+		return fmt.Sprintf("🗑️ Removed image %s, but cleaning up its layers failed: %v", image, err), nil
+	}
+
 	return fmt.Sprintf("🗑️ Successfully removed image: %s", image), nil
 }
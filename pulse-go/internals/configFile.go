@@ -0,0 +1,78 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// systemConfigDir holds the configuration files that apply when a user has none
+const systemConfigDir = "/etc/pulse"
+
+// readPulseConfig reads the configuration file name from ~/.pulse, or from
+// /etc/pulse if the user has none, and returns its contents and path. Neither
+// existing is not an error: the path is then "".
+func readPulseConfig(name string) ([]byte, string, error) {
+	userPath := filepath.Join(getPulseHome(), name)
+	data, err := readUserConfig(userPath)
+	if err == nil {
+		return data, userPath, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, "", err
+	}
+
+	systemPath := filepath.Join(systemConfigDir, name)
+	data, err = os.ReadFile(systemPath)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %v", systemPath, err)
+	}
+	return data, systemPath, nil
+}
+
+// readUserConfig reads a configuration file in a user's ~/.pulse. Running as root, e.g.
+// as the daemon, the file is only trusted if the user could not have written it: it
+// must be a regular file, not a symlink, owned by root and not writable by group or
+// others. Otherwise any user could relax TLS or the signature policy for root.
+func readUserConfig(path string) ([]byte, error) {
+	if os.Geteuid() != 0 {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		return data, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, fmt.Errorf("refusing %s: running as root, it must not be a symlink", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || st.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("refusing %s: running as root, it must be a regular file owned by root and not writable by group or others (or use %s)", path, filepath.Join(systemConfigDir, filepath.Base(path)))
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return data, nil
+}
@@ -2,12 +2,14 @@ package internals
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -119,9 +121,8 @@ func splitFields(s string) []string {
 	return fields
 }
 
-// ConfigureContainerNetwork sets up networking for a specific container
-func ConfigureContainerNetwork(containerPID int, containerID string) error {
-	// Generate unique veth pair names (handle short IDs)
+// vethNames returns the names of a container's veth pair (handle short IDs)
+func vethNames(containerID string) (host, container string) {
 	hostSuffix := containerID
 	if len(containerID) > 8 {
 		hostSuffix = containerID[:8]
@@ -130,9 +131,31 @@ func ConfigureContainerNetwork(containerPID int, containerID string) error {
 	if len(containerID) > 7 {
 		containerSuffix = containerID[:7]
 	}
+	return fmt.Sprintf("veth%s", hostSuffix), fmt.Sprintf("vethc%s", containerSuffix)
+}
+
+// removeContainerVeth deletes a veth pair left behind by a container. The pair
+// normally goes with the container's network namespace, but not if setting it up
+// failed before the container side was moved there.
+func removeContainerVeth(containerID string) error {
+	vethHost, _ := vethNames(containerID)
+	if _, err := net.InterfaceByName(vethHost); err != nil {
+		return nil
+	}
+	if err := exec.Command("ip", "link", "delete", vethHost).Run(); err != nil {
+		return fmt.Errorf("failed to delete %s: %v", vethHost, err)
+	}
+	return nil
+}
 
-	vethHost := fmt.Sprintf("veth%s", hostSuffix)
-	vethContainer := fmt.Sprintf("vethc%s", containerSuffix)
+// ConfigureContainerNetwork sets up networking for a specific container
+func ConfigureContainerNetwork(containerPID int, containerID string) error {
+	vethHost, vethContainer := vethNames(containerID)
+
+	// A restarted container reuses its names, clear a pair an earlier start left
+	if err := removeContainerVeth(containerID); err != nil {
+		return err
+	}
 
 	// Create veth pair
 	cmd := exec.Command("ip", "link", "add", vethHost, "type", "veth", "peer", "name", vethContainer)
@@ -189,20 +212,45 @@ func execInNetNS(netnsPath string, args ...string) error {
 	return cmd.Run()
 }
 
-func RunContainer(rootfs string, command []string, envVars []string, network bool, interactive bool) error {
+// RunContainer starts the process for a container record attached to the caller's
+// terminal and blocks until it exits. A container with a TTY gets a terminal of its
+// own, sized from sizes.
+func RunContainer(c *Container, sizes <-chan WindowSize) error {
+	cmd, term, err := StartContainer(c, os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	if term == nil {
+		return WaitContainer(c, cmd)
+	}
+
+	defer term.Close()
+	return term.Attach(os.Stdin, os.Stdout, sizes, func() error {
+		return WaitContainer(c, cmd)
+	})
+}
+
+// StartContainer launches the container process with the given stdio and records
+// its PID; the caller must call WaitContainer to reap it. A container with a TTY
+// gets a pseudo-terminal instead, which is returned: the caller writes its input to
+// it and reads its output from it. stdout and stderr then only see errors from
+// setting the container up.
+func StartContainer(c *Container, stdin io.Reader, stdout, stderr io.Writer) (*exec.Cmd, *Terminal, error) {
+	// Writes go to the container's own layer, never to the shared image rootfs
+	if err := mountContainerRootfs(c); err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare container rootfs: %v", err)
+	}
+	rootfs := c.Rootfs
+	command := c.Command
+
 	// When running with sudo, ensure rootfs directories are accessible
 	if os.Geteuid() == 0 && os.Getenv("SUDO_UID") != "" {
 		// Make the path traversable for the container process
 		makePathTraversable(rootfs)
-
-		// Also ensure the rootfs itself is owned by root so apt/etc can work
-		// This is necessary because the image was extracted as the user
-		// but the container runs as real root (no user namespace)
-		ensureRootOwnership(rootfs)
 	}
 
 	// Setup DNS before starting container (in parent process with proper permissions)
-	if network {
+	if c.Network {
 		if err := setupDNS(rootfs); err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: failed to setup DNS: %v\n", err)
 		}
@@ -226,15 +274,18 @@ func RunContainer(rootfs string, command []string, envVars []string, network boo
 				break
 			}
 		}
+		c.Command = command
 	}
 
 	cmd := exec.Command("/proc/self/exe", append([]string{"child"}, command...)...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if !c.Tty {
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	cmd.Env = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
-	cmd.Env = append(cmd.Env, envVars...)
+	cmd.Env = append(cmd.Env, c.Env...)
 
 	cloneFlags := uintptr(syscall.CLONE_NEWNS |
 		syscall.CLONE_NEWUTS |
@@ -272,32 +323,113 @@ func RunContainer(rootfs string, command []string, envVars []string, network boo
 	}
 
 	cmd.Env = append(cmd.Env, fmt.Sprintf("PULSE_ROOTFS=%s", rootfs))
-	cmd.Env = append(cmd.Env, fmt.Sprintf("PULSE_NETWORK=%v", network))
+	cmd.Env = append(cmd.Env, fmt.Sprintf("PULSE_NETWORK=%v", c.Network))
+	if c.WorkingDir != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PULSE_WORKDIR=%s", c.WorkingDir))
+	}
+	if c.User != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("PULSE_USER=%s", c.User))
+	}
 
-	// If networking is disabled, just run normally
-	if !network {
-		err := cmd.Run()
-		fixOwnership(rootfs)
-		return err
+	// The container gets a cgroup of its own when we may create one
+	if cgroup, err := createContainerCgroup(c); err == nil {
+		defer cgroup.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+
+	// The terminal has to come from the devpts instance the child mounts, so the
+	// child creates it and sends the master back over a socket (fd 3). It becomes the
+	// controlling terminal of the child's new session.
+	var console *os.File
+	if c.Tty {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			unmountContainerRootfs(c)
+			return nil, nil, fmt.Errorf("failed to create console socket: %v", err)
+		}
+		console = os.NewFile(uintptr(fds[0]), "console")
+		defer console.Close()
+		childConsole := os.NewFile(uintptr(fds[1]), "console")
+		defer childConsole.Close()
+
+		cmd.ExtraFiles = []*os.File{childConsole}
+		cmd.Env = append(cmd.Env, "PULSE_TTY=1")
+		cmd.SysProcAttr.Setsid = true
 	}
 
-	// For networking enabled, we need to configure after start
 	if err := cmd.Start(); err != nil {
-		return err
+		unmountContainerRootfs(c)
+		return nil, nil, err
+	}
+
+	var term *Terminal
+	if console != nil {
+		cmd.ExtraFiles[0].Close()
+		master, err := receiveFd(console, "ptmx")
+		if err != nil {
+			// The child failed before it got that far, and said why on stderr
+			cmd.Process.Kill()
+			cmd.Wait()
+			unmountContainerRootfs(c)
+			return nil, nil, fmt.Errorf("container did not set up its terminal")
+		}
+		term = &Terminal{master: master}
 	}
 
-	// Configure network for the container
-	containerID := fmt.Sprintf("%d", cmd.Process.Pid)
-	if err := ConfigureContainerNetwork(cmd.Process.Pid, containerID); err != nil {
-		cmd.Process.Kill()
-		return fmt.Errorf("failed to configure network: %v", err)
+	c.PID = cmd.Process.Pid
+	c.State = StateRunning
+	c.ExitCode = 0
+	c.Signal = ""
+	c.StartedAt = time.Now()
+	c.FinishedAt = time.Time{}
+	if err := SaveContainer(c); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record container state: %v\n", err)
 	}
 
+	// For networking enabled, we need to configure after start
+	if c.Network {
+		if err := ConfigureContainerNetwork(cmd.Process.Pid, c.ID); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			unmountContainerRootfs(c)
+			markExited(c, exitCode(cmd.ProcessState), exitSignal(cmd.ProcessState))
+			if term != nil {
+				term.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to configure network: %v", err)
+		}
+	}
+
+	return cmd, term, nil
+}
+
+// WaitContainer blocks until a started container exits and records it as exited,
+// with its exit code. The rootfs is unmounted first: once the record says exited, the
+// container can be started again on a new mount.
+func WaitContainer(c *Container, cmd *exec.Cmd) error {
 	err := cmd.Wait()
-	fixOwnership(rootfs)
+	code, signal := ExitCodeUnknown, ""
+	if cmd.ProcessState != nil {
+		code, signal = exitCode(cmd.ProcessState), exitSignal(cmd.ProcessState)
+	}
+	unmountContainerRootfs(c)
+	markExited(c, code, signal)
 	return err
 }
 
+// markExited records that the container process is gone
+func markExited(c *Container, code int, signal string) {
+	c.PID = 0
+	c.State = StateExited
+	c.ExitCode = code
+	c.Signal = signal
+	c.FinishedAt = time.Now()
+	if err := SaveContainer(c); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to record container state: %v\n", err)
+	}
+}
+
 // makePathTraversable ensures all parent directories are accessible
 func makePathTraversable(path string) {
 	// Get all parent directories
@@ -329,8 +461,9 @@ func makePathTraversable(path string) {
 	}
 }
 
-// ensureRootOwnership changes ownership of rootfs to root:root when running with sudo
-// This is needed because the container runs as real root without user namespace
+// ensureRootOwnership changes ownership of a container's private rootfs copy to root:root
+// when running with sudo. This is needed because the image was extracted as the user
+// but the container runs as real root (no user namespace), so apt/etc can work
 func ensureRootOwnership(rootfs string) {
 	// Recursively chown the rootfs to root
 	filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
@@ -343,28 +476,6 @@ func ensureRootOwnership(rootfs string) {
 	})
 }
 
-// fixOwnership changes ownership of rootfs back to the original user when run with sudo
-func fixOwnership(rootfs string) {
-	sudoUID := os.Getenv("SUDO_UID")
-	sudoGID := os.Getenv("SUDO_GID")
-
-	if sudoUID != "" && sudoGID != "" {
-		// Running under sudo, fix ownership back to original user
-		uid, _ := strconv.Atoi(sudoUID)
-		gid, _ := strconv.Atoi(sudoGID)
-
-		// Only fix ownership of files we might have created/modified
-		filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return nil // Skip errors
-			}
-			// Change ownership (ignore errors for system files)
-			os.Lchown(path, uid, gid)
-			return nil
-		})
-	}
-}
-
 func ChildProcess(args []string) error {
 	rootfs := os.Getenv("PULSE_ROOTFS")
 	if rootfs == "" {
@@ -391,42 +502,158 @@ func ChildProcess(args []string) error {
 		return fmt.Errorf("failed to set hostname: %v", err)
 	}
 
-	cmdPath := args[0]
+	// Only the container's own environment is passed on to the process
+	env := containerEnv(os.Environ())
 
-	if filepath.IsAbs(cmdPath) {
-		if _, err := os.Stat(cmdPath); err != nil {
-			return fmt.Errorf("command not found: %s", cmdPath)
+	var u *containerUser
+	if spec := os.Getenv("PULSE_USER"); spec != "" {
+		found, err := lookupContainerUser("/", spec)
+		if err != nil {
+			return err
 		}
-	} else {
-		found := false
-		searchPaths := []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin", "/usr/local/bin"}
-
-		for _, dir := range searchPaths {
-			testPath := filepath.Join(dir, cmdPath)
-			if _, err := os.Stat(testPath); err == nil {
-				cmdPath = testPath
-				found = true
-				break
-			}
+		u = found
+	}
+
+	if os.Getenv("PULSE_TTY") == "1" {
+		uid := 0
+		if u != nil {
+			uid = u.uid
+		}
+		if err := setupConsole(os.NewFile(3, "console"), uid); err != nil {
+			return err
 		}
+	}
 
-		if !found {
-			return fmt.Errorf("command not found: %s", cmdPath)
+	// Like Docker, create the working directory if the image lacks it. This needs root,
+	// so it happens before switching users; what is created belongs to the user.
+	workdir := os.Getenv("PULSE_WORKDIR")
+	if workdir != "" {
+		if err := createWorkdir(workdir, u); err != nil {
+			return fmt.Errorf("failed to create working directory %s: %v", workdir, err)
 		}
 	}
 
+	// Switch to the image/--user identity before anything else touches the rootfs
+	if u != nil {
+		if err := switchUser(u); err != nil {
+			return err
+		}
+		if !hasEnv(env, "HOME") && u.home != "" {
+			env = append(env, "HOME="+u.home)
+		}
+	} else if !hasEnv(env, "HOME") {
+		env = append(env, "HOME=/root")
+	}
+
+	if workdir != "" {
+		if err := os.Chdir(workdir); err != nil {
+			return fmt.Errorf("chdir to %s failed: %v", workdir, err)
+		}
+	}
+
+	cmdPath, err := lookPath(args[0], env)
+	if err != nil {
+		return err
+	}
+
 	args[0] = cmdPath
 
-	if err := syscall.Exec(cmdPath, args, os.Environ()); err != nil {
+	if err := syscall.Exec(cmdPath, args, env); err != nil {
 		return fmt.Errorf("exec failed for %s: %v", cmdPath, err)
 	}
 
 	return nil
 }
 
+// createWorkdir creates the missing directories of workdir, owned by u if it is set
+func createWorkdir(workdir string, u *containerUser) error {
+	path := "/"
+	for _, part := range strings.Split(filepath.Clean("/"+workdir), "/") {
+		if part == "" {
+			continue
+		}
+		path = filepath.Join(path, part)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		if err := os.Mkdir(path, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if u != nil {
+			if err := os.Chown(path, u.uid, u.gid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// containerEnv strips the PULSE_* variables used to configure the child
+func containerEnv(environ []string) []string {
+	var env []string
+	for _, entry := range environ {
+		if len(entry) >= 6 && entry[:6] == "PULSE_" {
+			continue
+		}
+		env = append(env, entry)
+	}
+	return env
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, entry := range env {
+		if len(entry) > len(name) && entry[:len(name)+1] == name+"=" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookPath resolves a command inside the container using the container's PATH
+func lookPath(cmdPath string, env []string) (string, error) {
+	if filepath.IsAbs(cmdPath) || containsSlash(cmdPath) {
+		if _, err := os.Stat(cmdPath); err != nil {
+			return "", fmt.Errorf("command not found: %s", cmdPath)
+		}
+		return cmdPath, nil
+	}
+
+	searchPath := "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	for _, entry := range env {
+		if len(entry) > 5 && entry[:5] == "PATH=" {
+			searchPath = entry[5:]
+		}
+	}
+
+	for _, dir := range filepath.SplitList(searchPath) {
+		if dir == "" {
+			continue
+		}
+		testPath := filepath.Join(dir, cmdPath)
+		if info, err := os.Stat(testPath); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return testPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("command not found: %s", cmdPath)
+}
+
+func containsSlash(s string) bool {
+	for _, c := range s {
+		if c == '/' {
+			return true
+		}
+	}
+	return false
+}
+
 func setupDNS(rootfs string) error {
-	// Copy host's resolv.conf to container
-	etcDir := filepath.Join(rootfs, "etc")
+	// Copy host's resolv.conf to container. /etc is resolved inside the rootfs so an
+	// image symlink cannot redirect this write (done as root) onto the host.
+	etcDir, err := resolveFullInRoot(rootfs, "/etc")
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(etcDir, 0755); err != nil {
 		return err
 	}
@@ -531,7 +758,12 @@ func isLocalhost(ip string) bool {
 }
 
 func setupMounts(rootfs string) error {
-	procPath := filepath.Join(rootfs, "proc")
+	// Mount points are resolved inside the rootfs, image symlinks must not be able
+	// to point them at host paths
+	procPath, err := resolveFullInRoot(rootfs, "/proc")
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(procPath, 0755); err != nil {
 		return err
 	}
@@ -539,7 +771,10 @@ func setupMounts(rootfs string) error {
 		return fmt.Errorf("failed to mount /proc: %v", err)
 	}
 
-	sysPath := filepath.Join(rootfs, "sys")
+	sysPath, err := resolveFullInRoot(rootfs, "/sys")
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(sysPath, 0755); err != nil {
 		return err
 	}
@@ -547,7 +782,10 @@ func setupMounts(rootfs string) error {
 		return fmt.Errorf("failed to mount /sys: %v", err)
 	}
 
-	tmpPath := filepath.Join(rootfs, "tmp")
+	tmpPath, err := resolveFullInRoot(rootfs, "/tmp")
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(tmpPath, 0755); err != nil {
 		return err
 	}
@@ -555,7 +793,10 @@ func setupMounts(rootfs string) error {
 		return fmt.Errorf("failed to mount /tmp: %v", err)
 	}
 
-	devPath := filepath.Join(rootfs, "dev")
+	devPath, err := resolveFullInRoot(rootfs, "/dev")
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(devPath, 0755); err != nil {
 		return err
 	}
@@ -570,7 +811,12 @@ func setupMounts(rootfs string) error {
 			continue
 		}
 
-		f, err := os.OpenFile(containerDev, os.O_CREATE|os.O_RDONLY, 0666)
+		// Replace image symlinks, the bind mount would otherwise follow them
+		if info, err := os.Lstat(containerDev); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(containerDev)
+		}
+
+		f, err := os.OpenFile(containerDev, os.O_CREATE|os.O_RDONLY|syscall.O_NOFOLLOW, 0666)
 		if err != nil {
 			continue
 		}
@@ -591,5 +837,11 @@ func setupMounts(rootfs string) error {
 		}
 	}
 
+	// Programs open /dev/ptmx for new terminals; it has to be this instance's
+	ptmxPath := filepath.Join(devPath, "ptmx")
+	if _, err := os.Lstat(ptmxPath); os.IsNotExist(err) {
+		os.Symlink("pts/ptmx", ptmxPath)
+	}
+
 	return nil
 }
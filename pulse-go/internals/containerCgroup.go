@@ -0,0 +1,100 @@
+package internals
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cgroup2Magic is the filesystem type of the cgroup v2 hierarchy
+const cgroup2Magic = 0x63677270
+
+// cgroup2Mount finds the cgroup v2 hierarchy. It is mounted on /sys/fs/cgroup, or on
+// /sys/fs/cgroup/unified next to the v1 controllers.
+func cgroup2Mount() (string, error) {
+	for _, dir := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		var fs syscall.Statfs_t
+		if syscall.Statfs(dir, &fs) == nil && fs.Type == cgroup2Magic {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy")
+}
+
+// openCgroup opens the cgroup v2 directory pid belongs to
+func openCgroup(pid int) (*os.File, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The unified hierarchy is the "0::/path" line
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return os.Open(filepath.Join(mount, filepath.Clean("/"+path)))
+		}
+	}
+	return nil, fmt.Errorf("process %d is not in a cgroup v2 hierarchy", pid)
+}
+
+// containerCgroup is the cgroup of a container, pulse/<id> in the v2 hierarchy
+func containerCgroup(c *Container) (string, error) {
+	mount, err := cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(mount, "pulse", c.ID), nil
+}
+
+// createContainerCgroup creates the container's cgroup and opens it for the container
+// process to be started in. Only root may; other containers share the caller's cgroup.
+func createContainerCgroup(c *Container) (*os.File, error) {
+	if os.Geteuid() != 0 {
+		return nil, fmt.Errorf("cgroups can only be created as root")
+	}
+	dir, err := containerCgroup(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	return os.Open(dir)
+}
+
+// removeContainerCgroup deletes the cgroup of a stopped container, killing whatever
+// is left in it first
+func removeContainerCgroup(c *Container) error {
+	dir, err := containerCgroup(c)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+
+	os.WriteFile(filepath.Join(dir, "cgroup.kill"), []byte("1"), 0644)
+	for i := 0; i < 50; i++ {
+		err = syscall.Rmdir(dir)
+		// EBUSY while the killed processes are on their way out
+		if err != syscall.EBUSY {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cgroup %s: %v", dir, err)
+	}
+	return nil
+}
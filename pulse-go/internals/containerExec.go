@@ -0,0 +1,213 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExecOptions describe a process started in a running container. User, WorkingDir
+// and Env default to the container's own; Env entries replace those of the same name.
+// With Tty the process gets a terminal of the container's, sized from Resize.
+type ExecOptions struct {
+	Cmd        []string
+	Env        []string
+	User       string
+	WorkingDir string
+	Tty        bool
+	Resize     <-chan WindowSize
+}
+
+// ExecContainer runs a command in the running container c and returns its exit code,
+// 128+n if signal n killed it. The process joins the container's mount, PID, UTS, IPC,
+// network and (if it has one) user namespaces, its root and its cgroup. Cancelling ctx
+// kills it. With a terminal, all of its output goes to stdout.
+//
+// The Go runtime is multithreaded and cannot setns into a mount or user namespace, so
+// nsenter does the joining; it forks into the PID namespace and exits with the status
+// of the command.
+func ExecContainer(ctx context.Context, c *Container, opts ExecOptions, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	reconcileState(c)
+	if c.State != StateRunning {
+		return 0, fmt.Errorf("container %s is not running", c.Name)
+	}
+	if len(opts.Cmd) == 0 {
+		return 0, fmt.Errorf("no command given")
+	}
+	pid := c.PID
+	root := fmt.Sprintf("/proc/%d/root", pid)
+
+	args := []string{"--target", strconv.Itoa(pid), "--mount", "--uts", "--ipc", "--net", "--pid"}
+	// Containers only get a user namespace when started without root
+	if !sameNamespace(pid, "user") {
+		args = append(args, "--user")
+	}
+
+	env := mergeEnv(c.Env, opts.Env)
+	if !hasEnv(env, "PATH") {
+		env = append([]string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}, env...)
+	}
+
+	spec := opts.User
+	if spec == "" {
+		spec = c.User
+	}
+	home := "/root"
+	uid := 0
+	if spec != "" {
+		u, err := lookupContainerUser(root, spec)
+		if err != nil {
+			return 0, err
+		}
+		// nsenter sets no supplementary groups
+		args = append(args, "--setgid", strconv.Itoa(u.gid), "--setuid", strconv.Itoa(u.uid))
+		home = u.home
+		uid = u.uid
+	}
+	if !hasEnv(env, "HOME") && home != "" {
+		env = append(env, "HOME="+home)
+	}
+
+	workdir := opts.WorkingDir
+	if workdir == "" {
+		workdir = c.WorkingDir
+	}
+	// nsenter opens --wd before it enters the namespaces, so it is given the directory
+	// as seen through the container's root
+	wd, err := resolveFullInRoot(root, workdir)
+	if err != nil {
+		return 0, err
+	}
+	if info, err := os.Stat(wd); err != nil || !info.IsDir() {
+		return 0, fmt.Errorf("working directory %s does not exist in the container", filepath.Clean("/"+workdir))
+	}
+	args = append(args, "--root", "--wd="+wd, "--")
+	args = append(args, opts.Cmd...)
+
+	cmd := exec.CommandContext(ctx, "nsenter", args...)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+
+	// Only root may move processes between cgroups it did not create
+	if os.Geteuid() == 0 {
+		if cgroup, err := openCgroup(pid); err == nil {
+			defer cgroup.Close()
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+		}
+	}
+
+	// The terminal comes from the container's devpts instance, seen through its root,
+	// and is the controlling terminal of a new session
+	var term *Terminal
+	var slave *os.File
+	if opts.Tty {
+		ptmx, err := resolveFullInRoot(root, "/dev/pts/ptmx")
+		if err != nil {
+			return 0, err
+		}
+		var master *os.File
+		master, slave, err = openPty(ptmx, func(n int) (string, error) {
+			return resolveFullInRoot(root, fmt.Sprintf("/dev/pts/%d", n))
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to allocate a terminal: %v", err)
+		}
+		term = &Terminal{master: master}
+		defer term.Close()
+
+		// Container IDs are only ours to give when we share its user namespace
+		if uid > 0 && sameNamespace(pid, "user") {
+			slave.Chown(uid, -1)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+	}
+
+	// Killing nsenter leaves the command running in the container, kill both
+	cmd.Cancel = func() error {
+		for _, child := range processChildren(cmd.Process.Pid) {
+			syscall.Kill(child, syscall.SIGKILL)
+		}
+		return cmd.Process.Kill()
+	}
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Start()
+	if slave != nil {
+		// Only the processes in the container may hold the slave, or the end of
+		// their output would never be seen
+		slave.Close()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to start nsenter: %v", err)
+	}
+	if term != nil {
+		err = term.Attach(stdin, stdout, opts.Resize, cmd.Wait)
+	} else {
+		err = cmd.Wait()
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return 0, err
+	}
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return exitCode(cmd.ProcessState), nil
+}
+
+// exitCode is the shell's view of how a process ended: its exit status, or 128+n if
+// signal n killed it
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// exitSignal is the name of the signal that killed a process, or "" if it exited
+func exitSignal(state *os.ProcessState) string {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return SignalName(status.Signal())
+	}
+	return ""
+}
+
+// sameNamespace reports whether pid is in the same namespace of the given type as us
+func sameNamespace(pid int, ns string) bool {
+	theirs, err1 := os.Readlink(fmt.Sprintf("/proc/%d/ns/%s", pid, ns))
+	ours, err2 := os.Readlink("/proc/self/ns/" + ns)
+	return err1 == nil && err2 == nil && theirs == ours
+}
+
+// processChildren lists the direct children of pid
+func processChildren(pid int) []int {
+	tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", pid))
+	var children []int
+	for _, task := range tasks {
+		data, err := os.ReadFile(task)
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			if child, err := strconv.Atoi(field); err == nil {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
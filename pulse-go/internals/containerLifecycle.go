@@ -0,0 +1,125 @@
+package internals
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultStopTimeout is how long StopContainer waits after SIGTERM before SIGKILL
+const DefaultStopTimeout = 10 * time.Second
+
+// StopContainer sends SIGTERM to a running container and SIGKILL once timeout has
+// passed. The container's process is PID 1 of its namespace, which only receives
+// SIGTERM if it installed a handler, so SIGKILL is what stops most shells.
+func StopContainer(c *Container, timeout time.Duration) error {
+	reconcileState(c)
+	if c.State != StateRunning {
+		return nil
+	}
+
+	pid := c.PID
+	syscall.Kill(pid, syscall.SIGTERM)
+	if !waitForExit(pid, timeout) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		if !waitForExit(pid, 5*time.Second) {
+			return fmt.Errorf("container %s did not stop", ShortID(c.ID))
+		}
+	}
+
+	// Whoever waits on the process records the exit; pick up what they recorded
+	if latest, err := WaitContainerExit(context.Background(), c); err == nil {
+		*c = *latest
+	}
+	return nil
+}
+
+// waitForExit polls until pid is gone or timeout passes
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// KillContainer sends sig to a running container's process. As PID 1 of its namespace
+// the process ignores signals it has no handler for, except SIGKILL.
+func KillContainer(c *Container, sig syscall.Signal) error {
+	reconcileState(c)
+	if c.State != StateRunning {
+		return fmt.Errorf("container %s is not running", c.Name)
+	}
+	if err := syscall.Kill(c.PID, sig); err != nil {
+		return fmt.Errorf("failed to signal container %s: %v", c.Name, err)
+	}
+	return nil
+}
+
+// ParseSignal accepts a signal by number or by name, with or without SIG (9, KILL,
+// SIGKILL, sigkill)
+func ParseSignal(name string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", n)
+		}
+		return syscall.Signal(n), nil
+	}
+
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+	if sig := unix.SignalNum(upper); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", name)
+}
+
+// WaitContainerExit blocks until a container is not running and returns its record
+// as it was left, with the exit code. The process that reaped the container records
+// the code, so the record is watched rather than the process.
+func WaitContainerExit(ctx context.Context, c *Container) (*Container, error) {
+	var goneSince time.Time
+	for {
+		latest, err := readContainer(c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("container %s was removed", c.Name)
+		}
+		if latest.State != StateRunning {
+			return latest, nil
+		}
+
+		// Give the reaper a moment to record the exit before deciding it is gone too
+		if !processAlive(latest.PID) {
+			if goneSince.IsZero() {
+				goneSince = time.Now()
+			} else if time.Since(goneSince) > time.Second {
+				reconcileState(latest)
+				return latest, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// SignalName returns the SIG name of sig, or its number if it has none
+func SignalName(sig syscall.Signal) string {
+	if name := unix.SignalName(sig); name != "" {
+		return name
+	}
+	return strconv.Itoa(int(sig))
+}
@@ -0,0 +1,274 @@
+package internals
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLogLine caps the output buffered while waiting for a newline, like Docker's 16KiB;
+// longer lines are stored as several partial entries
+const maxLogLine = 16 * 1024
+
+// logEntry is one line of a container's output as stored in container.log. Partial
+// entries are pieces of a line longer than maxLogLine, continued by the next entry of
+// the same stream.
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"`
+	Log     string    `json:"log"`
+	Partial bool      `json:"partial,omitempty"`
+}
+
+// ContainerLog appends timestamped stdout/stderr lines to a container's log file
+type ContainerLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	stdout *logStream
+	stderr *logStream
+}
+
+type logStream struct {
+	log     *ContainerLog
+	name    string
+	partial []byte
+}
+
+// OpenContainerLog opens (or creates) the log file for a container in append mode
+func OpenContainerLog(c *Container) (*ContainerLog, error) {
+	path := containerLogPath(c.ID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open container log: %v", err)
+	}
+	fixDirOwnership(path)
+
+	l := &ContainerLog{file: f}
+	l.stdout = &logStream{log: l, name: "stdout"}
+	l.stderr = &logStream{log: l, name: "stderr"}
+	return l, nil
+}
+
+func (l *ContainerLog) Stdout() io.Writer { return l.stdout }
+func (l *ContainerLog) Stderr() io.Writer { return l.stderr }
+
+// Close flushes any unterminated lines and closes the file
+func (l *ContainerLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stdout.flushPartial()
+	l.stderr.flushPartial()
+	return l.file.Close()
+}
+
+func (s *logStream) Write(p []byte) (int, error) {
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	data := append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i >= 0 && i < maxLogLine {
+			s.writeEntry(data[:i+1], false)
+			data = data[i+1:]
+			continue
+		}
+		// Output that never ends a line (progress bars, binary data) is not held forever
+		if len(data) >= maxLogLine {
+			s.writeEntry(data[:maxLogLine], true)
+			data = data[maxLogLine:]
+			continue
+		}
+		break
+	}
+	s.partial = append([]byte(nil), data...)
+
+	return len(p), nil
+}
+
+func (s *logStream) flushPartial() {
+	if len(s.partial) > 0 {
+		s.writeEntry(s.partial, false)
+		s.partial = nil
+	}
+}
+
+func (s *logStream) writeEntry(line []byte, partial bool) {
+	entry, _ := json.Marshal(logEntry{Time: time.Now().UTC(), Stream: s.name, Log: string(line), Partial: partial})
+	s.log.file.Write(append(entry, '\n'))
+}
+
+// LogOptions selects which log lines ReadContainerLogs returns
+type LogOptions struct {
+	Follow bool
+	Tail   int // Number of lines from the end, negative for all
+	Since  time.Time
+}
+
+// ReadContainerLogs writes the container's log lines prefixed with their timestamps.
+// With Follow it keeps streaming new lines until the container exits or ctx is done.
+func ReadContainerLogs(ctx context.Context, c *Container, opts LogOptions, w io.Writer) error {
+	f, err := os.Open(containerLogPath(c.ID))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no logs recorded for container %s", ShortID(c.ID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open container log: %v", err)
+	}
+	defer f.Close()
+
+	reader := &logReader{r: bufio.NewReader(f), lines: map[string]*logEntry{}}
+	var pending []logEntry
+	keep := func(entry logEntry) {
+		if entry.Time.Before(opts.Since) {
+			return
+		}
+		pending = append(pending, entry)
+		if opts.Tail >= 0 && len(pending) > opts.Tail {
+			pending = pending[1:]
+		}
+	}
+	for {
+		entry, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		keep(*entry)
+	}
+	// Following waits for the rest of a long line, otherwise it is shown as it is
+	if !opts.Follow {
+		for _, entry := range reader.unfinished() {
+			keep(entry)
+		}
+	}
+
+	flusher, _ := w.(interface{ Flush() })
+	for _, entry := range pending {
+		writeLogLine(w, entry)
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	if !opts.Follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		entry, err := reader.next()
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if entry != nil {
+			if !entry.Time.Before(opts.Since) {
+				writeLogLine(w, *entry)
+			}
+			continue
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// Caught up with the writer, stop once the container is gone
+		current, loadErr := LoadContainer(c.ID)
+		if loadErr != nil || current.State != StateRunning {
+			// Drain whatever was written between the last read and exit
+			for {
+				entry, err := reader.next()
+				if err != nil {
+					break
+				}
+				writeLogLine(w, *entry)
+			}
+			for _, entry := range reader.unfinished() {
+				writeLogLine(w, entry)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// logReader yields complete log entries, holding back a line that the writer has
+// only partially flushed until the rest of it arrives, and joining the partial entries
+// of a long line
+type logReader struct {
+	r       *bufio.Reader
+	partial []byte
+	lines   map[string]*logEntry // Partial entries joined so far, by stream
+}
+
+// next returns the next entry, or io.EOF when no complete line is available yet
+func (lr *logReader) next() (*logEntry, error) {
+	for {
+		line, err := lr.r.ReadBytes('\n')
+		lr.partial = append(lr.partial, line...)
+		if err != nil {
+			return nil, err
+		}
+
+		data := lr.partial
+		lr.partial = nil
+
+		var entry logEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue // Skip corrupt lines
+		}
+
+		// A long line is dated by its first piece
+		if joined, ok := lr.lines[entry.Stream]; ok {
+			joined.Log += entry.Log
+			entry.Time, entry.Log = joined.Time, joined.Log
+		}
+		if entry.Partial {
+			lr.lines[entry.Stream] = &entry
+			continue
+		}
+		delete(lr.lines, entry.Stream)
+		return &entry, nil
+	}
+}
+
+// unfinished returns the lines whose last piece was never written, because the
+// container's output ended with a full piece
+func (lr *logReader) unfinished() []logEntry {
+	var entries []logEntry
+	for stream, entry := range lr.lines {
+		entries = append(entries, *entry)
+		delete(lr.lines, stream)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	return entries
+}
+
+func writeLogLine(w io.Writer, entry logEntry) {
+	line := entry.Log
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	fmt.Fprintf(w, "%s %s", entry.Time.Format(time.RFC3339Nano), line)
+}
+
+func containerLogPath(id string) string {
+	return filepath.Join(containerDir(id), "container.log")
+}
@@ -0,0 +1,208 @@
+package internals
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	StorageOverlay = "overlay"
+	StorageCopy    = "copy"
+)
+
+// mountContainerRootfs gives the container its own writable root on top of the
+// read-only image rootfs. Overlayfs is preferred; when it is unavailable (rootless,
+// unsupported filesystem) the image is copied once into the container directory.
+func mountContainerRootfs(c *Container) error {
+	dir := containerDir(c.ID)
+
+	switch c.Storage {
+	case StorageOverlay:
+		return mountOverlay(c)
+	case StorageCopy:
+		return nil
+	}
+
+	// First start: pick a storage mode and remember it
+	err := mountOverlay(c)
+	if err == nil {
+		c.Storage = StorageOverlay
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "DEBUG: overlayfs unavailable (%v), copying image rootfs\n", err)
+
+	copyDir := filepath.Join(dir, "rootfs")
+	if err := os.RemoveAll(copyDir); err != nil {
+		return fmt.Errorf("failed to clean container rootfs: %v", err)
+	}
+	if err := copyTree(c.ImageRootfs, copyDir); err != nil {
+		os.RemoveAll(copyDir)
+		return fmt.Errorf("failed to copy image rootfs: %v", err)
+	}
+
+	// An image extracted without privileges is owned by the extracting user. The copy
+	// belongs to this container alone, so it can be handed to root once instead of
+	// flipping ownership around every run. Images extracted as root already carry
+	// the ownership recorded in their layers.
+	if os.Geteuid() == 0 && os.Getenv("SUDO_UID") != "" && !ownedByRoot(c.ImageRootfs) {
+		ensureRootOwnership(copyDir)
+	}
+
+	c.Storage = StorageCopy
+	c.Rootfs = copyDir
+	return nil
+}
+
+func mountOverlay(c *Container) error {
+	dir := containerDir(c.ID)
+	upper := filepath.Join(dir, "upper")
+	work := filepath.Join(dir, "work")
+	merged := filepath.Join(dir, "merged")
+
+	for _, d := range []string{upper, work, merged} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", c.ImageRootfs, upper, work)
+	if err := syscall.Mount("overlay", merged, "overlay", 0, options); err != nil {
+		return fmt.Errorf("overlay mount failed: %v", err)
+	}
+
+	c.Rootfs = merged
+	return nil
+}
+
+func ownedByRoot(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Uid == 0
+}
+
+// unmountContainerRootfs releases the overlay mount once the container has exited
+func unmountContainerRootfs(c *Container) {
+	if c.Storage != StorageOverlay {
+		return
+	}
+	syscall.Unmount(filepath.Join(containerDir(c.ID), "merged"), syscall.MNT_DETACH)
+}
+
+// RemoveContainer deletes a stopped container's record, logs and writable layer,
+// and its cgroup and any veth pair it left behind
+func RemoveContainer(c *Container) error {
+	if c.State == StateRunning && processAlive(c.PID) {
+		return fmt.Errorf("container %s is running, stop it first", ShortID(c.ID))
+	}
+
+	unmountContainerRootfs(c)
+	if err := removeContainerCgroup(c); err != nil {
+		return err
+	}
+	if err := removeContainerVeth(c.ID); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(containerDir(c.ID)); err != nil {
+		return fmt.Errorf("failed to remove container %s: %v", ShortID(c.ID), err)
+	}
+	releaseName(c)
+	return nil
+}
+
+// copyTree copies a directory tree preserving modes, symlinks and, when running
+// as root, ownership and device nodes
+func copyTree(src, dst string) error {
+	type dirMode struct {
+		path string
+		mode os.FileMode
+	}
+	var dirs []dirMode
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(path, target, mode.Perm()); err != nil {
+				return err
+			}
+		default:
+			// Devices, FIFOs and sockets can only be recreated with privileges
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok || os.Geteuid() != 0 {
+				return nil
+			}
+			if err := syscall.Mknod(target, stat.Mode, int(stat.Rdev)); err != nil {
+				return nil
+			}
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+			os.Lchown(target, int(stat.Uid), int(stat.Gid))
+		}
+		perm := mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if mode.IsDir() {
+			// Read-only directories must stay writable until their contents are copied
+			dirs = append(dirs, dirMode{target, perm})
+		} else if mode&os.ModeSymlink == 0 {
+			// Chmod after chown, chown clears setuid/setgid bits
+			os.Chmod(target, perm)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chmod(dirs[i].path, dirs[i].mode)
+	}
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
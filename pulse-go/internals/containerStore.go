@@ -0,0 +1,420 @@
+package internals
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	StateCreated = "created"
+	StateRunning = "running"
+	StateExited  = "exited"
+)
+
+// ExitCodeUnknown is the exit code of a container whose process died without anyone
+// waiting on it, e.g. with the daemon that started it
+const ExitCodeUnknown = -1
+
+// Container is the persistent record of a container, stored as
+// ~/.pulse/containers/<id>/config.json
+type Container struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Image       string    `json:"image"`
+	Command     []string  `json:"command"`
+	Env         []string  `json:"env,omitempty"`
+	WorkingDir  string    `json:"working_dir,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Network     bool      `json:"network"`
+	Tty         bool      `json:"tty,omitempty"`        // the process gets a pseudo-terminal
+	OpenStdin   bool      `json:"open_stdin,omitempty"` // the daemon keeps its input open for pulse attach
+	Rootfs      string    `json:"rootfs"`               // Container's own writable root
+	ImageRootfs string    `json:"image_rootfs"`         // Read-only extracted image it is layered on
+	Storage     string    `json:"storage"`              // overlay or copy, chosen on first start
+	PID         int       `json:"pid"`
+	State       string    `json:"state"`
+	ExitCode    int       `json:"exit_code"`        // of the last run, 128+n if signal n killed it
+	Signal      string    `json:"signal,omitempty"` // that killed the last run, e.g. SIGKILL
+	Created     time.Time `json:"created"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+}
+
+var containerMu sync.Mutex
+
+// NewContainer generates an ID (and a name if none was given) and stores the record
+func NewContainer(name, image, imageRootfs string, config *RunConfig, network bool) (*Container, error) {
+	id, err := generateID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate container ID: %v", err)
+	}
+
+	if name == "" {
+		if name, err = generateName(id); err != nil {
+			return nil, err
+		}
+	} else if err := reserveName(name, id); err != nil {
+		return nil, err
+	}
+
+	// Containers record the full reference so they match the image however it was typed
+	if normalized, err := NormalizeImage(image); err == nil {
+		image = normalized
+	}
+
+	c := &Container{
+		ID:          id,
+		Name:        name,
+		Image:       image,
+		Command:     config.Command,
+		Env:         config.Env,
+		WorkingDir:  config.WorkingDir,
+		User:        config.User,
+		Network:     network,
+		ImageRootfs: imageRootfs,
+		State:       StateCreated,
+		Created:     time.Now(),
+	}
+
+	// Under the store lock a prune either sees this container or has already removed
+	// its image's layers, which must then not be used
+	unlock, err := lockStore(false)
+	if err != nil {
+		releaseName(c)
+		return nil, err
+	}
+	defer unlock()
+	if imageRootfs != "" {
+		if _, err := os.Stat(imageRootfs); err != nil {
+			releaseName(c)
+			return nil, fmt.Errorf("image %s was removed while the container was being created", image)
+		}
+	}
+
+	if err := SaveContainer(c); err != nil {
+		releaseName(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// validName is Docker's rule for container names; names are also file names here
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// staleReservation is how old a name reservation without a container record must be
+// before it is taken to be left over from a creator that crashed
+const staleReservation = time.Minute
+
+// reserveName claims name for the container id. A name is held by the file
+// ~/.pulse/names/<name>, which link() creates only if it does not exist, so of two
+// processes creating containers with the same name only one gets it.
+func reserveName(name, id string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid container name %q: only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+
+	containerMu.Lock()
+	defer containerMu.Unlock()
+
+	// Records from before names were reserved have no reservation
+	if nameRecorded(name) {
+		return fmt.Errorf("container name %s is already in use", name)
+	}
+
+	dir := getNamesDir()
+	tmp, err := os.CreateTemp(dir, ".reserve-")
+	if err != nil {
+		return fmt.Errorf("failed to reserve container name: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(id)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to reserve container name: %v", err)
+	}
+
+	path := filepath.Join(dir, name)
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Link(tmp.Name(), path)
+		if err == nil {
+			fixDirOwnership(path)
+			return nil
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to reserve container name: %v", err)
+		}
+		if !staleName(path) {
+			break
+		}
+		os.Remove(path)
+	}
+	return fmt.Errorf("container name %s is already in use", name)
+}
+
+// staleName reports whether the reservation at path belongs to no container
+func staleName(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) < staleReservation {
+		return false
+	}
+	owner, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(containerDir(string(owner)))
+	return os.IsNotExist(err)
+}
+
+// nameRecorded reports whether a container record has the name. It reads the records
+// as they are, since reconciling them would save them under containerMu.
+func nameRecorded(name string) bool {
+	entries, err := os.ReadDir(getContainersDir())
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if c, err := readContainer(entry.Name()); err == nil && c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseName gives up the name of a container being removed
+func releaseName(c *Container) {
+	path := filepath.Join(getNamesDir(), c.Name)
+	if owner, err := os.ReadFile(path); err == nil && string(owner) == c.ID {
+		os.Remove(path)
+	}
+}
+
+// SaveContainer writes the record atomically so a crash never leaves half a file
+func SaveContainer(c *Container) error {
+	containerMu.Lock()
+	defer containerMu.Unlock()
+
+	dir := containerDir(c.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create container directory: %v", err)
+	}
+	fixDirOwnership(dir)
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The daemon and a local pulse run can save the same record, so each writes its own
+	// temporary file
+	tmp, err := os.CreateTemp(dir, ".config-*")
+	if err != nil {
+		return fmt.Errorf("failed to write container record: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write container record: %v", err)
+	}
+	tmp.Close()
+	os.Chmod(tmp.Name(), 0644)
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := os.Rename(tmp.Name(), configPath); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write container record: %v", err)
+	}
+	fixDirOwnership(configPath)
+	return nil
+}
+
+// LoadContainer finds a container by full ID, unique ID prefix or name
+func LoadContainer(ref string) (*Container, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("empty container reference")
+	}
+
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*Container
+	for _, c := range containers {
+		if c.ID == ref || c.Name == ref {
+			return c, nil
+		}
+		if strings.HasPrefix(c.ID, ref) {
+			matches = append(matches, c)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("container reference %s is ambiguous", ref)
+	}
+}
+
+// ListContainers returns records newest first; exited containers only when all is set
+func ListContainers(all bool) ([]*Container, error) {
+	entries, err := os.ReadDir(getContainersDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read containers directory: %v", err)
+	}
+
+	var containers []*Container
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		c, err := readContainer(entry.Name())
+		if err != nil {
+			continue // Skip records that are mid-creation or corrupt
+		}
+
+		reconcileState(c)
+
+		if !all && c.State != StateRunning {
+			continue
+		}
+		containers = append(containers, c)
+	}
+
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created.After(containers[j].Created)
+	})
+	return containers, nil
+}
+
+func readContainer(id string) (*Container, error) {
+	data, err := os.ReadFile(filepath.Join(containerDir(id), "config.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var c Container
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid container record %s: %v", id, err)
+	}
+	return &c, nil
+}
+
+// reconcileState marks a container exited if its process died without us noticing
+// (e.g. the daemon that started it was killed)
+func reconcileState(c *Container) {
+	if c.State != StateRunning || processAlive(c.PID) {
+		return
+	}
+	// The process that reaped it may have just recorded the exit, keep its exit code
+	if latest, err := readContainer(c.ID); err == nil && latest.State != StateRunning {
+		*c = *latest
+		return
+	}
+
+	c.State = StateExited
+	c.PID = 0
+	c.ExitCode = ExitCodeUnknown
+	c.Signal = ""
+	if c.FinishedAt.IsZero() {
+		c.FinishedAt = time.Now()
+	}
+	SaveContainer(c)
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// ShortID returns the 12 character form of the ID shown by the CLI
+func ShortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func generateID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+var (
+	nameAdjectives = []string{
+		"brave", "calm", "eager", "fancy", "gentle", "happy", "jolly", "keen",
+		"lucid", "mighty", "nimble", "quiet", "rapid", "silent", "swift", "witty",
+	}
+	nameNouns = []string{
+		"badger", "comet", "falcon", "galaxy", "heron", "lynx", "meteor", "nova",
+		"otter", "panda", "pulsar", "quasar", "raven", "tiger", "viper", "zebra",
+	}
+)
+
+// generateName picks a free name and reserves it for the container id
+func generateName(id string) (string, error) {
+	for attempt := 0; attempt < 100; attempt++ {
+		name := randomPick(nameAdjectives) + "_" + randomPick(nameNouns)
+		if attempt >= 10 {
+			// Names are running out, add a numeric suffix to keep them unique
+			suffix, _ := rand.Int(rand.Reader, big.NewInt(1000))
+			name = fmt.Sprintf("%s%d", name, suffix.Int64())
+		}
+		if err := reserveName(name, id); err == nil {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find a free container name")
+}
+
+func randomPick(words []string) string {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return words[0]
+	}
+	return words[n.Int64()]
+}
+
+func containerDir(id string) string {
+	return filepath.Join(getContainersDir(), id)
+}
+
+// getNamesDir holds the reservations of container names
+func getNamesDir() string {
+	namesDir := filepath.Join(getPulseHome(), "names")
+	if err := os.MkdirAll(namesDir, 0755); err == nil {
+		fixDirOwnership(namesDir)
+	}
+	return namesDir
+}
+
+func getContainersDir() string {
+	containersDir := filepath.Join(getPulseHome(), "containers")
+
+	// Ensure the directory exists with proper permissions
+	if err := os.MkdirAll(containersDir, 0755); err == nil {
+		fixDirOwnership(containersDir)
+	}
+
+	return containersDir
+}
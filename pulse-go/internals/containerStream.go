@@ -0,0 +1,137 @@
+package internals
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Kinds of frames in a container stream. The daemon switches the connection of a
+// request for a terminal, or to attach, to this protocol: every frame is an 8 byte
+// header (kind, three zero bytes, big-endian payload length) and the payload.
+const (
+	StreamStdin  byte = 0 // client to daemon: input, numbered like its file descriptor
+	StreamStdout byte = 1 // daemon to client: output
+	StreamStderr byte = 2 // daemon to client: error output, merged into stdout with a terminal
+	StreamResize byte = 3 // client to daemon: a WindowSize
+	StreamExit   byte = 4 // daemon to client, last: an ExitStatus
+)
+
+// StreamUpgrade is the protocol name of the Upgrade header that asks for a stream
+const StreamUpgrade = "pulse-stream"
+
+// maxFrame bounds the payload of a frame a peer may make us allocate
+const maxFrame = 1 << 20
+
+// ExitStatus ends a container stream: the exit code of the process (128+n if signal n
+// killed it, and then the signal's name), or why it could not be run
+type ExitStatus struct {
+	ExitCode int    `json:"exit_code"`
+	Signal   string `json:"signal,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ContainerExitStatus is the exit status recorded for the last run of c
+func ContainerExitStatus(c *Container) ExitStatus {
+	return ExitStatus{ExitCode: c.ExitCode, Signal: c.Signal}
+}
+
+// String describes how the process ended, for the user
+func (s ExitStatus) String() string {
+	switch {
+	case s.Error != "":
+		return "❌ Container failed: " + s.Error
+	case s.Signal != "":
+		return fmt.Sprintf("❌ Container killed by %s (exit code %d)", s.Signal, s.ExitCode)
+	case s.ExitCode == ExitCodeUnknown:
+		return "❌ Container exited with an unknown exit code"
+	case s.ExitCode != 0:
+		return fmt.Sprintf("❌ Container exited with code %d", s.ExitCode)
+	}
+	return "✅ Container exited successfully"
+}
+
+// Code is the exit code a command reporting s ends with, like a shell's: the
+// process's, or 1 if it is unknown
+func (s ExitStatus) Code() int {
+	if s.Error != "" || s.ExitCode == ExitCodeUnknown {
+		return 1
+	}
+	return s.ExitCode
+}
+
+// StreamWriter writes frames; it is safe for concurrent use
+type StreamWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewStreamWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{w: w}
+}
+
+// WriteFrame writes one frame of the given kind
+func (s *StreamWriter) WriteFrame(kind byte, payload []byte) error {
+	var header [8]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(payload)
+	return err
+}
+
+// WriteJSON writes v as the payload of a frame
+func (s *StreamWriter) WriteJSON(kind byte, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.WriteFrame(kind, payload)
+}
+
+// Stream returns a writer whose writes become frames of the given kind
+func (s *StreamWriter) Stream(kind byte) io.Writer {
+	return streamFrames{s, kind}
+}
+
+type streamFrames struct {
+	s    *StreamWriter
+	kind byte
+}
+
+func (f streamFrames) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := f.s.WriteFrame(f.kind, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ReadFrame reads the next frame written by a StreamWriter
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > maxFrame {
+		return 0, nil, fmt.Errorf("stream frame of %d bytes is too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
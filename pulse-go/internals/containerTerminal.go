@@ -0,0 +1,230 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// WindowSize is the size of a terminal in characters
+type WindowSize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// Terminal is our side (the master) of a container process's pseudo-terminal.
+// Everything the process writes to its stdout and stderr is read from it, and what
+// is written to it is the process's input.
+type Terminal struct {
+	master *os.File
+}
+
+// Read returns io.EOF once every process in the container has closed the terminal
+func (t *Terminal) Read(p []byte) (int, error) {
+	n, err := t.master.Read(p)
+	// Linux reports a pty with no slave left open as EIO
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (t *Terminal) Write(p []byte) (int, error) {
+	return t.master.Write(p)
+}
+
+// Resize sets the terminal's size; the process gets SIGWINCH
+func (t *Terminal) Resize(size WindowSize) error {
+	if size.Rows == 0 || size.Cols == 0 {
+		return nil
+	}
+	return withFd(t.master, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, &unix.Winsize{Row: size.Rows, Col: size.Cols})
+	})
+}
+
+func (t *Terminal) Close() error {
+	return t.master.Close()
+}
+
+// followResize applies sizes to the terminal until sizes is closed or done is
+func (t *Terminal) followResize(sizes <-chan WindowSize, done <-chan struct{}) {
+	for {
+		select {
+		case size, ok := <-sizes:
+			if !ok {
+				return
+			}
+			t.Resize(size)
+		case <-done:
+			return
+		}
+	}
+}
+
+// copyOutput copies the terminal to out until the processes holding it are gone.
+// Processes left in the background once exited says the command is done may keep it
+// open, so after that the copy only goes on for a moment.
+func (t *Terminal) copyOutput(out io.Writer, exited <-chan struct{}) {
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(out, t)
+		close(copied)
+	}()
+
+	select {
+	case <-copied:
+		return
+	case <-exited:
+	}
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+		// Unblocks the copy
+		t.master.SetReadDeadline(time.Now())
+		<-copied
+	}
+}
+
+// openPty opens a new pseudo-terminal of the devpts instance whose ptmx is at ptmx.
+// slavePath turns the number of the pty into the path of its slave. Both ends are
+// opened without becoming anyone's controlling terminal.
+func openPty(ptmx string, slavePath func(n int) (string, error)) (*os.File, *os.File, error) {
+	master, err := os.OpenFile(ptmx, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %v", ptmx, err)
+	}
+
+	var n int
+	err = withFd(master, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return fmt.Errorf("failed to unlock pty: %v", err)
+		}
+		ptn, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		if err != nil {
+			return fmt.Errorf("failed to get pty number: %v", err)
+		}
+		n = ptn
+		return nil
+	})
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+
+	path, err := slavePath(n)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return master, slave, nil
+}
+
+// withFd runs fn on the descriptor of f. Unlike f.Fd() it leaves f non-blocking, so
+// reads of the master can still be interrupted with a deadline.
+func withFd(f *os.File, fn func(fd int) error) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := raw.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// sendFd passes f over the unix socket sock
+func sendFd(sock *os.File, f *os.File) error {
+	return withFd(f, func(fd int) error {
+		return syscall.Sendmsg(int(sock.Fd()), []byte{0}, syscall.UnixRights(fd), nil, 0)
+	})
+}
+
+// receiveFd receives a file passed by sendFd
+func receiveFd(sock *os.File, name string) (*os.File, error) {
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := syscall.Recvmsg(int(sock.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) == 0 {
+		return nil, fmt.Errorf("no file received")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) == 0 {
+		return nil, fmt.Errorf("no file received")
+	}
+	return os.NewFile(uintptr(fds[0]), name), nil
+}
+
+// setupConsole runs in the container, after the chroot. It gives the process a
+// terminal of the container's own devpts instance, as its controlling terminal and
+// stdio, and passes the master over sock to the runtime.
+func setupConsole(sock *os.File, uid int) error {
+	defer sock.Close()
+
+	master, slave, err := openPty("/dev/pts/ptmx", func(n int) (string, error) {
+		return fmt.Sprintf("/dev/pts/%d", n), nil
+	})
+	if err != nil {
+		return err
+	}
+	defer slave.Close()
+
+	err = sendFd(sock, master)
+	master.Close()
+	if err != nil {
+		return fmt.Errorf("failed to pass the terminal on: %v", err)
+	}
+
+	// The terminal belongs to the user the process runs as
+	if uid > 0 {
+		slave.Chown(uid, -1)
+	}
+
+	// The runtime started us as a session leader
+	if err := unix.IoctlSetInt(int(slave.Fd()), unix.TIOCSCTTY, 0); err != nil {
+		return fmt.Errorf("failed to set controlling terminal: %v", err)
+	}
+	for fd := 0; fd <= 2; fd++ {
+		if err := syscall.Dup2(int(slave.Fd()), fd); err != nil {
+			return fmt.Errorf("failed to attach terminal: %v", err)
+		}
+	}
+	return nil
+}
+
+// Attach connects the terminal to stdin and stdout, and applies sizes to it, while
+// wait waits for the process. Output still buffered when the process exits is copied
+// before Attach returns.
+func (t *Terminal) Attach(stdin io.Reader, stdout io.Writer, sizes <-chan WindowSize, wait func() error) error {
+	exited := make(chan struct{})
+	go t.followResize(sizes, exited)
+	if stdin != nil {
+		// Left behind blocked on stdin if the process exits first
+		go io.Copy(t, stdin)
+	}
+	copied := make(chan struct{})
+	go func() {
+		t.copyOutput(stdout, exited)
+		close(copied)
+	}()
+
+	err := wait()
+	close(exited)
+	<-copied
+	return err
+}
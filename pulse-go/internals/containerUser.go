@@ -0,0 +1,137 @@
+package internals
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// containerUser is a resolved `user[:group]` spec from the image config or --user
+type containerUser struct {
+	uid    int
+	gid    int
+	groups []int
+	home   string
+}
+
+// lookupContainerUser resolves name/uid and optional group/gid against the
+// /etc/passwd and /etc/group of the container whose root is root ("/" after chroot)
+func lookupContainerUser(root, spec string) (*containerUser, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+
+	u := &containerUser{}
+	name := ""
+	found := false
+
+	passwd, _ := readColonFile(root, "/etc/passwd")
+	if uid, err := strconv.Atoi(userPart); err == nil {
+		u.uid = uid
+		for _, fields := range passwd {
+			if len(fields) >= 6 && fields[2] == userPart {
+				name, found = fields[0], true
+				u.gid, _ = strconv.Atoi(fields[3])
+				u.home = fields[5]
+				break
+			}
+		}
+		if !found {
+			// Numeric users need not exist in /etc/passwd; like Docker, they are in
+			// group 0 unless the spec names a group
+			u.gid = 0
+			u.home = "/"
+		}
+	} else {
+		for _, fields := range passwd {
+			if len(fields) >= 6 && fields[0] == userPart {
+				name, found = fields[0], true
+				u.uid, _ = strconv.Atoi(fields[2])
+				u.gid, _ = strconv.Atoi(fields[3])
+				u.home = fields[5]
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userPart)
+		}
+	}
+
+	groups, _ := readColonFile(root, "/etc/group")
+	if hasGroup {
+		if gid, err := strconv.Atoi(groupPart); err == nil {
+			u.gid = gid
+		} else {
+			matched := false
+			for _, fields := range groups {
+				if len(fields) >= 3 && fields[0] == groupPart {
+					u.gid, _ = strconv.Atoi(fields[2])
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unable to find group %s: no matching entries in group file", groupPart)
+			}
+		}
+	}
+
+	// Supplementary groups listing the user by name
+	u.groups = []int{u.gid}
+	if name != "" && !hasGroup {
+		for _, fields := range groups {
+			if len(fields) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(fields[3], ",") {
+				if member == name {
+					if gid, err := strconv.Atoi(fields[2]); err == nil && gid != u.gid {
+						u.groups = append(u.groups, gid)
+					}
+				}
+			}
+		}
+	}
+
+	return u, nil
+}
+
+// switchUser drops to the given identity; groups first since setuid removes the right to change them
+func switchUser(u *containerUser) error {
+	// Rootless user namespaces deny setgroups, keep the inherited groups there
+	if err := syscall.Setgroups(u.groups); err != nil && err != syscall.EPERM {
+		return fmt.Errorf("setgroups failed: %v", err)
+	}
+	if err := syscall.Setgid(u.gid); err != nil {
+		return fmt.Errorf("setgid %d failed: %v", u.gid, err)
+	}
+	if err := syscall.Setuid(u.uid); err != nil {
+		return fmt.Errorf("setuid %d failed: %v", u.uid, err)
+	}
+	return nil
+}
+
+func readColonFile(root, name string) ([][]string, error) {
+	// The files belong to the image, their symlinks must not lead out of root
+	path, err := resolveFullInRoot(root, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
@@ -3,87 +3,138 @@ package internals
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
 )
 
 type OCIIndex struct {
-	Manifests []struct {
-		Digest string `json:"digest"`
-	} `json:"manifests"`
+	Manifests []OCIDescriptor `json:"manifests"`
+}
+
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
 }
 
 type OCIManifest struct {
-	Layers []struct {
-		Digest string `json:"digest"`
-	} `json:"layers"`
+	Config OCIDescriptor   `json:"config"`
+	Layers []OCIDescriptor `json:"layers"`
 }
 
-func Extract(image string) (string, error) {
-	imageDir := filepath.Join(getImagesDir(), fmt.Sprintf("%s-oci", sanitize(image)))
-	extractDir := filepath.Join(imageDir, "rootfs")
+// maxIndexDepth bounds how many nested image indexes findManifest descends through
+const maxIndexDepth = 4
 
-	// Check if extraction already exists and is complete
-	markerFile := filepath.Join(extractDir, ".extraction_complete")
-	if _, err := os.Stat(markerFile); err == nil {
-		// Already extracted, return existing directory
-		return extractDir, nil
+// Extract unpacks the image for platform ("" for the host) and returns its rootfs.
+// Layers are applied through the shared layer cache, so only layers no other image
+// has extracted yet are unpacked.
+func Extract(image, platform string) (string, error) {
+	target, err := ParsePlatform(platform)
+	if err != nil {
+		return "", err
 	}
 
-	// Remove any incomplete extraction
-	if err := os.RemoveAll(extractDir); err != nil {
-		return "", fmt.Errorf("failed to clean existing rootfs: %v", err)
+	manifest, err := readManifest(image, target)
+	if err != nil {
+		return "", err
 	}
 
-	// Create fresh extraction directory
-	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create rootfs directory: %v", err)
+	// The config's diff_ids are the digests of the uncompressed layers
+	config, err := readImageConfig(manifest)
+	if err != nil {
+		return "", err
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return "", fmt.Errorf("image config lists %d diff_ids for %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	if len(manifest.Layers) == 0 {
+		return "", fmt.Errorf("image %s has no layers", image)
 	}
 
-	indexFile := filepath.Join(imageDir, "index.json")
-	indexData, err := os.ReadFile(indexFile)
+	unlock, err := lockStore(false)
 	if err != nil {
-		return "", fmt.Errorf("failed to read index.json: %v", err)
+		return "", err
 	}
+	defer unlock()
 
-	var index OCIIndex
-	if err := json.Unmarshal(indexData, &index); err != nil {
-		return "", fmt.Errorf("invalid index.json")
+	return applyLayers(manifest.Layers, config.RootFS.DiffIDs)
+}
+
+// readManifest loads the manifest recorded for platform when the image was pulled
+func readManifest(image string, platform Platform) (*OCIManifest, error) {
+	record, err := loadImageRecord(image)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(index.Manifests) == 0 {
-		return "", fmt.Errorf("no manifest found")
+	m, available := record.manifestFor(platform)
+	if m == nil {
+		return nil, fmt.Errorf("no manifest for platform %s in image %s (available: %s)", platform, image, strings.Join(available, ", "))
 	}
 
-	manifestDigest := strings.TrimPrefix(index.Manifests[0].Digest, "sha256:")
-	manifestPath := filepath.Join(imageDir, "blobs/sha256", manifestDigest)
-	manifestData, err := os.ReadFile(manifestPath)
+	data, err := readBlob(m.Digest)
 	if err != nil {
-		return "", fmt.Errorf("failed to read manifest: %v", err)
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
 	}
-
 	var manifest OCIManifest
-	if err := json.Unmarshal(manifestData, &manifest); err != nil {
-		return "", fmt.Errorf("invalid manifest JSON: %v", err)
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest JSON: %v", err)
+	}
+	return &manifest, nil
+}
+
+// findManifest picks the manifest for platform out of an OCI index, descending into
+// nested image indexes. Entries whose descriptor carries no platform are matched on
+// the os/architecture recorded in their image config. It returns the manifest digest.
+func findManifest(descriptors []OCIDescriptor, platform Platform, available *[]string, depth int) (*OCIManifest, string, error) {
+	if depth > maxIndexDepth {
+		return nil, "", fmt.Errorf("image indexes nested too deeply")
 	}
 
-	// Extract all layers
-	for _, layer := range manifest.Layers {
-		layerDigest := strings.TrimPrefix(layer.Digest, "sha256:")
-		layerPath := filepath.Join(imageDir, "blobs/sha256", layerDigest)
+	for _, desc := range descriptors {
+		// Entries labelled with another platform (including attestations) need not be read
+		if desc.Platform != nil && !platform.matches(*desc.Platform) {
+			*available = append(*available, desc.Platform.normalize().String())
+			continue
+		}
 
-		if err := extractTar(layerPath, extractDir); err != nil {
-			// Clean up on failure
-			os.RemoveAll(extractDir)
-			return "", fmt.Errorf("failed to extract layer %s: %v", layerDigest, err)
+		data, err := readBlob(desc.Digest)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read manifest: %v", err)
 		}
-	}
 
-	// Mark extraction as complete
-	if f, err := os.Create(markerFile); err == nil {
-		f.Close()
-	}
+		// An index has manifests, an image manifest has a config and layers
+		var blob struct {
+			OCIIndex
+			OCIManifest
+		}
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, "", fmt.Errorf("invalid manifest JSON: %v", err)
+		}
 
-	return extractDir, nil
+		if blob.Manifests != nil {
+			manifest, digest, err := findManifest(blob.Manifests, platform, available, depth+1)
+			if manifest != nil || err != nil {
+				return manifest, digest, err
+			}
+			continue
+		}
+
+		manifest := &blob.OCIManifest
+		if desc.Platform != nil {
+			return manifest, desc.Digest, nil
+		}
+
+		config, err := readImageConfig(manifest)
+		if err != nil {
+			return nil, "", err
+		}
+		entry := Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+		if platform.matches(entry) {
+			return manifest, desc.Digest, nil
+		}
+		*available = append(*available, entry.normalize().String())
+	}
+	return nil, "", nil
 }
@@ -2,27 +2,139 @@ package internals
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mediaTypeOCILayer        = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeOCILayerZstd    = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeDockerLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeign   = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	// estargz layers are gzip layers carrying this annotation and a few extra
+	// bookkeeping entries that are not part of the image filesystem
+	estargzTOCAnnotation = "containerd.io/snapshot/stargz/toc.digest"
 )
 
-func extractTar(tarPath, destDir string) error {
-	f, err := os.Open(tarPath)
+var estargzEntries = map[string]bool{
+	"stargz.index.json":     true,
+	".prefetch.landmark":    true,
+	".no.prefetch.landmark": true,
+}
+
+// extractLayer streams a layer blob through the decompressor its media type calls
+// for, extracts it into destDir and checks the uncompressed stream against diffID
+func extractLayer(layerPath string, layer OCIDescriptor, diffID string, destDir string) error {
+	algorithm, expected, ok := strings.Cut(diffID, ":")
+	if !ok || algorithm != "sha256" {
+		return fmt.Errorf("unsupported diff_id %q", diffID)
+	}
+
+	f, err := os.Open(layerPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	gz, err := gzip.NewReader(f)
+	decompressed, err := decompressLayer(bufio.NewReader(f), layer.MediaType)
 	if err != nil {
-		return fmt.Errorf("not a gzip: %v", err)
+		return err
+	}
+	defer decompressed.Close()
+
+	hasher := sha256.New()
+	stream := io.TeeReader(decompressed, hasher)
+
+	var skip map[string]bool
+	if _, ok := layer.Annotations[estargzTOCAnnotation]; ok {
+		skip = estargzEntries
+	}
+
+	if err := extractTar(stream, destDir, skip); err != nil {
+		return err
+	}
+
+	// The diff_id covers the padding after the end-of-archive marker as well
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return fmt.Errorf("failed to read layer: %v", err)
+	}
+
+	if actual := hex.EncodeToString(hasher.Sum(nil)); actual != expected {
+		return fmt.Errorf("diff_id mismatch: image config expects sha256:%s, layer contains sha256:%s", expected, actual)
+	}
+	return nil
+}
+
+// decompressLayer picks the decompressor from the layer media type. Descriptors
+// without a media type (very old manifests) are sniffed instead.
+func decompressLayer(r *bufio.Reader, mediaType string) (io.ReadCloser, error) {
+	switch {
+	case mediaType == "":
+		magic, _ := r.Peek(4)
+		switch {
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			return decompressLayer(r, mediaTypeOCILayerGzip)
+		case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+			return decompressLayer(r, mediaTypeOCILayerZstd)
+		default:
+			return decompressLayer(r, mediaTypeOCILayer)
+		}
+	case mediaType == mediaTypeOCILayerGzip, mediaType == mediaTypeDockerLayerGzip,
+		mediaType == mediaTypeDockerForeign, isNondistributable(mediaType, "+gzip"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("not a gzip: %v", err)
+		}
+		return gz, nil
+	case mediaType == mediaTypeOCILayerZstd, isNondistributable(mediaType, "+zstd"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("not a zstd stream: %v", err)
+		}
+		return zr.IOReadCloser(), nil
+	case mediaType == mediaTypeOCILayer, mediaType == mediaTypeDockerLayer, isNondistributable(mediaType, ""):
+		return io.NopCloser(r), nil
+	default:
+		return nil, fmt.Errorf("unsupported layer media type %q", mediaType)
 	}
-	defer gz.Close()
+}
+
+// isNondistributable matches application/vnd.oci.image.layer.nondistributable.v1.tar<suffix>
+func isNondistributable(mediaType, suffix string) bool {
+	return mediaType == "application/vnd.oci.image.layer.nondistributable.v1.tar"+suffix
+}
+
+// extractTar applies one uncompressed layer to destDir. Entries named in skip are
+// format bookkeeping and are not extracted.
+func extractTar(r io.Reader, destDir string, skip map[string]bool) error {
+	tarReader := tar.NewReader(r)
 
-	tarReader := tar.NewReader(gz)
+	// Paths written by this layer, so an opaque marker only hides lower layers
+	created := map[string]bool{}
+
+	type dirEntry struct {
+		header *tar.Header
+		target string
+	}
+	var dirs []dirEntry
+	privileged := os.Geteuid() == 0
+	skipped := 0
 
 	for {
 		header, err := tarReader.Next()
@@ -33,21 +145,77 @@ func extractTar(tarPath, destDir string) error {
 			return err
 		}
 
-		target := filepath.Join(destDir, header.Name)
+		if escapesRoot(header.Name) {
+			return fmt.Errorf("refusing layer entry %q: path escapes the rootfs", header.Name)
+		}
+
+		name := filepath.Clean("/" + header.Name)
+		base := filepath.Base(name)
+		if skip[strings.TrimPrefix(name, "/")] {
+			continue
+		}
+		if name == "/" && header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("refusing layer entry %q: replaces the rootfs itself", header.Name)
+		}
+
+		// Symlinks left by earlier entries may only lead to places below destDir,
+		// so nothing can be written outside the rootfs through them
+		target, err := resolveBeneath(destDir, name)
+		if err != nil {
+			return fmt.Errorf("refusing layer entry %q: %v", header.Name, err)
+		}
+
+		// OCI whiteouts: markers are applied to the rootfs, never extracted themselves
+		if base == whiteoutOpaque {
+			if err := applyOpaque(filepath.Dir(target), filepath.Dir(name), created); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			hiddenName := strings.TrimPrefix(base, whiteoutPrefix)
+			if hiddenName == "" || hiddenName == "." || hiddenName == ".." {
+				return fmt.Errorf("refusing layer entry %q: invalid whiteout", header.Name)
+			}
+			hidden := filepath.Join(filepath.Dir(target), hiddenName)
+			if err := os.RemoveAll(hidden); err != nil {
+				return fmt.Errorf("failed to apply whiteout %s: %v", header.Name, err)
+			}
+			continue
+		}
+
+		// A layer lists each path once; a second entry could replace a symlink the
+		// layer itself planted
+		if created[name] && header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("refusing layer entry %q: the layer already has an entry for this path", header.Name)
+		}
+		markCreated(created, name)
+
+		// An entry replaces whatever a lower layer had at the same path, unless
+		// both are directories (then the contents merge)
+		if existing, err := os.Lstat(target); err == nil {
+			if header.Typeflag != tar.TypeDir || !existing.IsDir() {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Create parent directories
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
+			if err := os.MkdirAll(target, 0755); err != nil {
 				return err
 			}
+			// Directory times are set last, extracting children would change them
+			dirs = append(dirs, dirEntry{header, target})
 		case tar.TypeReg:
-			// Create parent directories
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
-
-			// Create the file
-			out, err := os.Create(target)
+			// Create the file; O_EXCL|O_NOFOLLOW as the old entry was removed above
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
 			if err != nil {
 				return err
 			}
@@ -58,21 +226,168 @@ func extractTar(tarPath, destDir string) error {
 				return err
 			}
 			out.Close()
-
-			// CRITICAL: Preserve file permissions (including execute bit)
-			if err := os.Chmod(target, os.FileMode(header.Mode)); err != nil {
-				return err
-			}
 		case tar.TypeSymlink:
-			// Handle symbolic links
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			if err := os.Symlink(header.Linkname, target); err != nil {
 				return err
 			}
-			if err := os.Symlink(header.Linkname, target); err != nil {
-				// Ignore errors if symlink already exists
-				if !os.IsExist(err) {
-					return err
+		case tar.TypeLink:
+			// Hardlink targets are archive paths, relative to the layer root
+			if escapesRoot(header.Linkname) {
+				return fmt.Errorf("refusing hardlink %q: target %q escapes the rootfs", header.Name, header.Linkname)
+			}
+			linkTarget, err := resolveBeneath(destDir, filepath.Clean("/"+header.Linkname))
+			if err != nil {
+				return fmt.Errorf("refusing hardlink %q: %v", header.Name, err)
+			}
+			if info, err := os.Lstat(linkTarget); err == nil && info.IsDir() {
+				return fmt.Errorf("refusing hardlink %q: target %q is a directory", header.Name, header.Linkname)
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return fmt.Errorf("failed to create hardlink %s: %v", header.Name, err)
+			}
+			// A hardlink shares the inode (and so the attributes) of its target
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := makeSpecialFile(target, header); err != nil {
+				if !privileged && (os.IsPermission(err) || err == unix.EPERM) {
+					// Rootless: device nodes cannot be created, the container
+					// cannot use them anyway
+					skipped++
+					continue
 				}
+				return fmt.Errorf("failed to create %s: %v", header.Name, err)
+			}
+		default:
+			// Sockets, sparse and vendor types have no meaning in a rootfs
+			continue
+		}
+
+		if err := applyAttributes(target, header, privileged); err != nil {
+			return fmt.Errorf("failed to restore attributes of %s: %v", header.Name, err)
+		}
+	}
+
+	// Deepest directories first so a parent's time is not disturbed afterwards
+	for i := len(dirs) - 1; i >= 0; i-- {
+		// A later entry may have replaced the directory (possibly with a symlink)
+		if info, err := os.Lstat(dirs[i].target); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := applyAttributes(dirs[i].target, dirs[i].header, privileged); err != nil {
+			return fmt.Errorf("failed to restore attributes of %s: %v", dirs[i].header.Name, err)
+		}
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "DEBUG: skipped %d device nodes (no privileges to create them)\n", skipped)
+	}
+	return nil
+}
+
+func makeSpecialFile(target string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		return unix.Mkfifo(target, mode)
+	}
+	return unix.Mknod(target, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+}
+
+// applyAttributes restores ownership, xattrs, mode and times of an extracted entry.
+// Without privileges ownership and protected xattrs are left as they are: in rootless
+// mode the extracting user is mapped to root inside the container anyway.
+func applyAttributes(target string, header *tar.Header, privileged bool) error {
+	if err := os.Lchown(target, header.Uid, header.Gid); err != nil && privileged {
+		return err
+	}
+
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			// security.* and trusted.* need privileges, some filesystems lack xattrs
+			if err == unix.EPERM || err == unix.ENOTSUP || err == unix.EACCES {
+				continue
+			}
+			return err
+		}
+	}
+
+	if header.Typeflag != tar.TypeSymlink {
+		mode := header.FileInfo().Mode()
+		if !privileged && header.Typeflag == tar.TypeDir {
+			// Later layers are extracted by the same unprivileged user and must
+			// still be able to write here
+			mode |= 0700
+		}
+		// Chmod after chown, chown clears setuid/setgid bits
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+
+	times := []unix.Timespec{
+		unix.NsecToTimespec(accessTime(header).UnixNano()),
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW); err != nil && err != unix.ENOTSUP {
+		return err
+	}
+	return nil
+}
+
+func accessTime(header *tar.Header) time.Time {
+	if header.AccessTime.IsZero() {
+		return header.ModTime
+	}
+	return header.AccessTime
+}
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// markCreated records a path and its parents as written by the current layer
+func markCreated(created map[string]bool, name string) {
+	for name != "/" && !created[name] {
+		created[name] = true
+		name = filepath.Dir(name)
+	}
+}
+
+// applyOpaque removes everything below dir (found at realDir) that lower layers put
+// there, keeping entries the current layer has already written
+func applyOpaque(realDir, dir string, created map[string]bool) error {
+	entries, err := os.ReadDir(realDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		realPath := filepath.Join(realDir, entry.Name())
+		if !created[name] {
+			if err := os.RemoveAll(realPath); err != nil {
+				return fmt.Errorf("failed to apply opaque whiteout in %s: %v", dir, err)
+			}
+			continue
+		}
+		// ReadDir does not follow symlinks, so this never descends out of the rootfs
+		if entry.IsDir() {
+			if err := applyOpaque(realPath, name, created); err != nil {
+				return err
 			}
 		}
 	}
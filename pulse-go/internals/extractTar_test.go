@@ -0,0 +1,555 @@
+package internals
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+// layerTime is the modification time of every test layer entry
+var layerTime = time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+
+// tarEntry is one entry of a test layer. OUTSIDE in name, link or body is replaced
+// by the path of the sentinel directory next to the rootfs. Mode defaults to 0755 for
+// directories and 0644 for everything else.
+type tarEntry struct {
+	name   string
+	typ    byte
+	link   string
+	body   string
+	mode   int64
+	major  int64
+	minor  int64
+	xattrs map[string]string
+}
+
+func buildLayer(t *testing.T, outside string, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		body := strings.ReplaceAll(e.body, "OUTSIDE", outside)
+		header := &tar.Header{
+			Name:     strings.ReplaceAll(e.name, "OUTSIDE", outside),
+			Typeflag: e.typ,
+			Linkname: strings.ReplaceAll(e.link, "OUTSIDE", outside),
+			Mode:     0644,
+			Size:     int64(len(body)),
+			ModTime:  layerTime,
+			Devmajor: e.major,
+			Devminor: e.minor,
+			Format:   tar.FormatPAX,
+		}
+		if e.typ == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if e.mode != 0 {
+			header.Mode = e.mode
+		}
+		for key, value := range e.xattrs {
+			if header.PAXRecords == nil {
+				header.PAXRecords = map[string]string{}
+			}
+			header.PAXRecords[paxXattrPrefix+key] = value
+		}
+		if e.typ != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Size > 0 {
+			if _, err := tw.Write([]byte(body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// extractIntoSandbox extracts the layer into <tmp>/rootfs, next to the sentinel
+// directory <tmp>/outside, and returns tmp and the extraction error
+func extractIntoSandbox(t *testing.T, entries []tarEntry) (string, error) {
+	t.Helper()
+	tmp := t.TempDir()
+	outside := filepath.Join(tmp, "outside")
+	root := filepath.Join(tmp, "rootfs")
+	for _, dir := range []string{outside, root} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "sentinel"), []byte("untouched"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := extractTar(buildLayer(t, outside, entries), root, nil)
+	return tmp, err
+}
+
+// assertContained fails the test if anything but the rootfs and the untouched
+// sentinel exists in tmp
+func assertContained(t *testing.T, tmp string) {
+	t.Helper()
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "rootfs" && entry.Name() != "outside" {
+			t.Errorf("layer created %s outside the rootfs", entry.Name())
+		}
+	}
+
+	outside, err := os.ReadDir(filepath.Join(tmp, "outside"))
+	if err != nil {
+		t.Fatalf("sentinel directory: %v", err)
+	}
+	for _, entry := range outside {
+		if entry.Name() != "sentinel" {
+			t.Errorf("layer created outside/%s", entry.Name())
+		}
+	}
+	info, err := os.Lstat(filepath.Join(tmp, "outside", "sentinel"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("sentinel was replaced: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(tmp, "outside", "sentinel"))
+	if err != nil || string(data) != "untouched" {
+		t.Errorf("sentinel was written: %q, %v", data, err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink != 1 {
+		t.Errorf("sentinel was hardlinked into the rootfs (%d links)", stat.Nlink)
+	}
+}
+
+func TestExtractTarRejectsHostileLayers(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"dotdot name", []tarEntry{
+			{name: "../escaped", typ: tar.TypeReg, body: "x"},
+		}},
+		{"nested dotdot name", []tarEntry{
+			{name: "a/../../outside/escaped", typ: tar.TypeReg, body: "x"},
+		}},
+		{"dotdot directory", []tarEntry{
+			{name: "../escaped/", typ: tar.TypeDir},
+		}},
+		{"write through absolute symlink", []tarEntry{
+			{name: "lnk", typ: tar.TypeSymlink, link: "OUTSIDE"},
+			{name: "lnk/pwned", typ: tar.TypeReg, body: "x"},
+		}},
+		{"overwrite through absolute symlink", []tarEntry{
+			{name: "lnk", typ: tar.TypeSymlink, link: "OUTSIDE"},
+			{name: "lnk/sentinel", typ: tar.TypeReg, body: "pwned"},
+		}},
+		{"write through relative symlink", []tarEntry{
+			{name: "a/", typ: tar.TypeDir},
+			{name: "a/lnk", typ: tar.TypeSymlink, link: "../../outside"},
+			{name: "a/lnk/pwned", typ: tar.TypeReg, body: "x"},
+		}},
+		{"write through chained symlinks", []tarEntry{
+			{name: "one", typ: tar.TypeSymlink, link: "two"},
+			{name: "two", typ: tar.TypeSymlink, link: "OUTSIDE"},
+			{name: "one/pwned", typ: tar.TypeReg, body: "x"},
+		}},
+		{"directory through symlink", []tarEntry{
+			{name: "lnk", typ: tar.TypeSymlink, link: "../outside"},
+			{name: "lnk/pwned/", typ: tar.TypeDir},
+		}},
+		{"hardlink to dotdot path", []tarEntry{
+			{name: "h", typ: tar.TypeLink, link: "../outside/sentinel"},
+		}},
+		{"hardlink to absolute host path", []tarEntry{
+			{name: "h", typ: tar.TypeLink, link: "/../../../../../../OUTSIDE/sentinel"},
+		}},
+		{"hardlink through symlink", []tarEntry{
+			{name: "lnk", typ: tar.TypeSymlink, link: "OUTSIDE"},
+			{name: "h", typ: tar.TypeLink, link: "lnk/sentinel"},
+		}},
+		{"whiteout of dot", []tarEntry{
+			{name: "a/", typ: tar.TypeDir},
+			{name: "a/.wh..", typ: tar.TypeReg},
+		}},
+		{"whiteout of dotdot", []tarEntry{
+			{name: "a/", typ: tar.TypeDir},
+			{name: "a/.wh...", typ: tar.TypeReg},
+		}},
+		{"whiteout through symlink", []tarEntry{
+			{name: "lnk", typ: tar.TypeSymlink, link: "OUTSIDE"},
+			{name: "lnk/.wh.sentinel", typ: tar.TypeReg},
+		}},
+		{"symlink replaced by a file", []tarEntry{
+			{name: "f", typ: tar.TypeSymlink, link: "OUTSIDE/sentinel"},
+			{name: "f", typ: tar.TypeReg, body: "pwned"},
+		}},
+		{"file for the rootfs itself", []tarEntry{
+			{name: ".", typ: tar.TypeReg, body: "x"},
+		}},
+		{"symlink for the rootfs itself", []tarEntry{
+			{name: "/", typ: tar.TypeSymlink, link: "OUTSIDE"},
+			{name: "pwned", typ: tar.TypeReg, body: "x"},
+		}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp, err := extractIntoSandbox(t, tc.entries)
+			if err == nil {
+				t.Error("extraction succeeded")
+			}
+			assertContained(t, tmp)
+		})
+	}
+}
+
+// Symlinks that stay inside the rootfs, such as lib -> usr/lib, are still followed
+func TestExtractTarFollowsSymlinksInsideRootfs(t *testing.T) {
+	tmp, err := extractIntoSandbox(t, []tarEntry{
+		{name: "usr/lib/", typ: tar.TypeDir},
+		{name: "lib", typ: tar.TypeSymlink, link: "usr/lib"},
+		{name: "lib/libc.so", typ: tar.TypeReg, body: "elf"},
+		{name: "etc/", typ: tar.TypeDir},
+		{name: "etc/alternatives", typ: tar.TypeSymlink, link: "/usr/lib"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertContained(t, tmp)
+
+	data, err := os.ReadFile(filepath.Join(tmp, "rootfs", "usr", "lib", "libc.so"))
+	if err != nil || string(data) != "elf" {
+		t.Errorf("lib/libc.so did not land in usr/lib: %q, %v", data, err)
+	}
+}
+
+// extractLayers applies the layers in order to a fresh rootfs and returns its path
+func extractLayers(t *testing.T, layers ...[]tarEntry) string {
+	t.Helper()
+	root := t.TempDir()
+	for i, entries := range layers {
+		if err := extractTar(buildLayer(t, "", entries), root, nil); err != nil {
+			t.Fatalf("layer %d: %v", i, err)
+		}
+	}
+	return root
+}
+
+func TestExtractTarAppliesWhiteouts(t *testing.T) {
+	lower := []tarEntry{
+		{name: "etc/", typ: tar.TypeDir},
+		{name: "etc/a", typ: tar.TypeReg, body: "a"},
+		{name: "etc/b", typ: tar.TypeReg, body: "b"},
+		{name: "d/", typ: tar.TypeDir},
+		{name: "d/old", typ: tar.TypeReg, body: "old"},
+		{name: "d/sub/", typ: tar.TypeDir},
+		{name: "d/sub/old", typ: tar.TypeReg, body: "old"},
+	}
+
+	cases := []struct {
+		name    string
+		upper   []tarEntry
+		present []string
+		absent  []string
+	}{
+		{"whiteout removes a lower file", []tarEntry{
+			{name: "etc/.wh.a", typ: tar.TypeReg},
+		}, []string{"etc/b"}, []string{"etc/a", "etc/.wh.a"}},
+		{"whiteout removes a lower directory", []tarEntry{
+			{name: ".wh.d", typ: tar.TypeReg},
+		}, []string{"etc/a"}, []string{"d", ".wh.d"}},
+		{"opaque directory before the layer's entries", []tarEntry{
+			{name: "d/", typ: tar.TypeDir},
+			{name: "d/.wh..wh..opq", typ: tar.TypeReg},
+			{name: "d/new", typ: tar.TypeReg, body: "new"},
+		}, []string{"d/new", "etc/a"}, []string{"d/old", "d/sub", "d/.wh..wh..opq"}},
+		{"opaque directory after the layer's entries", []tarEntry{
+			{name: "d/", typ: tar.TypeDir},
+			{name: "d/new", typ: tar.TypeReg, body: "new"},
+			{name: "d/sub/", typ: tar.TypeDir},
+			{name: "d/sub/new", typ: tar.TypeReg, body: "new"},
+			{name: "d/.wh..wh..opq", typ: tar.TypeReg},
+		}, []string{"d/new", "d/sub/new"}, []string{"d/old", "d/sub/old", "d/.wh..wh..opq"}},
+		{"whiteout of a missing path", []tarEntry{
+			{name: ".wh.nothing", typ: tar.TypeReg},
+			{name: "missing/.wh.nothing", typ: tar.TypeReg},
+		}, []string{"etc/a", "d/old"}, []string{".wh.nothing", "missing"}},
+		{"opaque marker in a missing directory", []tarEntry{
+			{name: "missing/.wh..wh..opq", typ: tar.TypeReg},
+		}, []string{"etc/a", "d/old"}, []string{"missing"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := extractLayers(t, lower, tc.upper)
+			for _, name := range tc.present {
+				if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+					t.Errorf("%s is missing: %v", name, err)
+				}
+			}
+			for _, name := range tc.absent {
+				if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+					t.Errorf("%s exists", name)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTarRestoresAttributes(t *testing.T) {
+	root := extractLayers(t, []tarEntry{
+		{name: "bin/", typ: tar.TypeDir},
+		{name: "bin/tool", typ: tar.TypeReg, body: "elf", mode: 04755},
+		// A hardlink's own header does not change the inode it shares
+		{name: "bin/alias", typ: tar.TypeLink, link: "bin/tool", mode: 0600},
+		{name: "data/", typ: tar.TypeDir, mode: 0750},
+		{name: "data/secret", typ: tar.TypeReg, body: "s", mode: 0600, xattrs: map[string]string{"user.pulse": "1"}},
+	})
+
+	tool, err := os.Lstat(filepath.Join(root, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := tool.Mode() & (os.ModePerm | os.ModeSetuid); mode != os.ModeSetuid|0755 {
+		t.Errorf("bin/tool has mode %v, want the setuid bit and 0755", mode)
+	}
+	if !tool.ModTime().Equal(layerTime) {
+		t.Errorf("bin/tool was modified at %v, want %v", tool.ModTime(), layerTime)
+	}
+
+	alias, err := os.Lstat(filepath.Join(root, "bin", "alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(tool, alias) {
+		t.Error("bin/alias is not a hardlink of bin/tool")
+	}
+	if alias.Mode() != tool.Mode() || !alias.ModTime().Equal(tool.ModTime()) {
+		t.Errorf("bin/alias has mode %v and time %v, not those of bin/tool", alias.Mode(), alias.ModTime())
+	}
+
+	// Directory times are restored after their contents are written
+	data, err := os.Lstat(filepath.Join(root, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Mode().Perm() != 0750 || !data.ModTime().Equal(layerTime) {
+		t.Errorf("data has mode %v and time %v", data.Mode().Perm(), data.ModTime())
+	}
+
+	secret := filepath.Join(root, "data", "secret")
+	if info, err := os.Lstat(secret); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("data/secret: %v, %v", info, err)
+	}
+	// Not every filesystem holding the test's temporary directory has user xattrs
+	probe := filepath.Join(root, "probe")
+	if err := os.WriteFile(probe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); err != nil {
+		t.Logf("not checking xattrs: %v", err)
+		return
+	}
+	value := make([]byte, 16)
+	n, err := unix.Lgetxattr(secret, "user.pulse", value)
+	if err != nil || string(value[:n]) != "1" {
+		t.Errorf("data/secret lost its xattr: %q, %v", value[:n], err)
+	}
+}
+
+// Without privileges device nodes cannot be created; they are skipped and the rest of
+// the layer is extracted
+func TestExtractTarSkipsDevicesRootless(t *testing.T) {
+	if os.Geteuid() == 0 {
+		runAsNobody(t)
+		return
+	}
+
+	root := extractLayers(t, []tarEntry{
+		{name: "dev/", typ: tar.TypeDir},
+		{name: "dev/null", typ: tar.TypeChar, major: 1, minor: 3, mode: 0666},
+		{name: "dev/sda", typ: tar.TypeBlock, major: 8, mode: 0660},
+		{name: "dev/initctl", typ: tar.TypeFifo, mode: 0600},
+		{name: "etc/", typ: tar.TypeDir},
+		{name: "etc/hostname", typ: tar.TypeReg, body: "box"},
+	})
+
+	for _, name := range []string{"dev/null", "dev/sda"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+			t.Errorf("%s was created", name)
+		}
+	}
+	// Unlike device nodes, FIFOs need no privileges
+	if info, err := os.Lstat(filepath.Join(root, "dev", "initctl")); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("dev/initctl is not a FIFO: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "etc", "hostname")); err != nil || string(data) != "box" {
+		t.Errorf("etc/hostname: %q, %v", data, err)
+	}
+}
+
+// runAsNobody runs the current test again in a copy of the test binary as the nobody
+// user (65534), for behaviour that only shows without privileges
+func runAsNobody(t *testing.T) {
+	t.Helper()
+	// The test binary's own directory is private to root
+	dir, err := os.MkdirTemp("", "pulse-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	os.Chmod(dir, 0755)
+
+	binary := filepath.Join(dir, "pulse.test")
+	src, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(binary, os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+
+	cmd := exec.Command(binary, "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		t.Fatalf("as nobody:\n%s", out)
+	}
+	if err != nil {
+		t.Skipf("cannot run the test as nobody: %v", err)
+	}
+	t.Logf("as nobody:\n%s", out)
+}
+
+func gzipBlob(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBlob(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractLayerMediaTypes(t *testing.T) {
+	layer := buildLayer(t, "", []tarEntry{{name: "hello", typ: tar.TypeReg, body: "hi"}}).Bytes()
+	diffID := testDigest(layer)
+
+	cases := []struct {
+		name      string
+		mediaType string
+		blob      []byte
+		fails     bool
+	}{
+		{"plain tar", mediaTypeOCILayer, layer, false},
+		{"docker tar", mediaTypeDockerLayer, layer, false},
+		{"gzip", mediaTypeOCILayerGzip, gzipBlob(t, layer), false},
+		{"docker gzip", mediaTypeDockerLayerGzip, gzipBlob(t, layer), false},
+		{"zstd", mediaTypeOCILayerZstd, zstdBlob(t, layer), false},
+		{"sniffed tar", "", layer, false},
+		{"sniffed gzip", "", gzipBlob(t, layer), false},
+		{"sniffed zstd", "", zstdBlob(t, layer), false},
+		{"gzip declared as zstd", mediaTypeOCILayerZstd, gzipBlob(t, layer), true},
+		{"zstd declared as gzip", mediaTypeOCILayerGzip, zstdBlob(t, layer), true},
+		{"unsupported media type", "application/vnd.oci.image.layer.v1.tar+bzip2", layer, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			blob := filepath.Join(t.TempDir(), "blob")
+			if err := os.WriteFile(blob, tc.blob, 0644); err != nil {
+				t.Fatal(err)
+			}
+			root := t.TempDir()
+			err := extractLayer(blob, OCIDescriptor{MediaType: tc.mediaType}, diffID, root)
+			if tc.fails {
+				if err == nil {
+					t.Error("extraction succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(filepath.Join(root, "hello")); err != nil || string(data) != "hi" {
+				t.Errorf("hello: %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestApplyLayersRejectsDiffIDMismatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SUDO_UID", "")
+
+	layer := buildLayer(t, "", []tarEntry{{name: "hello", typ: tar.TypeReg, body: "hi"}}).Bytes()
+	blob := gzipBlob(t, layer)
+	descriptor := OCIDescriptor{MediaType: mediaTypeOCILayerGzip, Digest: testDigest(blob), Size: int64(len(blob))}
+	path, err := blobPath(descriptor.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, blob, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = applyLayers([]OCIDescriptor{descriptor}, []string{testDigest([]byte("another layer"))})
+	if err == nil || !strings.Contains(err.Error(), "diff_id mismatch") {
+		t.Fatalf("expected a diff_id mismatch, got %v", err)
+	}
+	snapshots, err := os.ReadDir(filepath.Join(getLayersDir(), "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range snapshots {
+		t.Errorf("left %s in the layer store", entry.Name())
+	}
+
+	// The matching diff_id still extracts the same blob
+	snapshot, err := applyLayers([]OCIDescriptor{descriptor}, []string{testDigest(layer)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(snapshot, "hello")); err != nil || string(data) != "hi" {
+		t.Errorf("hello: %q, %v", data, err)
+	}
+}
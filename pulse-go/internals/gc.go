@@ -0,0 +1,285 @@
+package internals
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// lockStore takes the store lock shared by pulls and extractions, or exclusively for
+// garbage collection, so collection never sees a half-written pull or snapshot.
+// It is an flock, so the daemon and local `pulse run -i` processes honour it too.
+func lockStore(exclusive bool) (func(), error) {
+	path := filepath.Join(getPulseHome(), "store.lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store lock: %v", err)
+	}
+	fixDirOwnership(path)
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock store: %v", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// storeRefs is the set of blobs and layer snapshots that some image or container uses
+type storeRefs struct {
+	blobs     map[string]bool // blob file names (hex digests)
+	snapshots map[string]bool // snapshot directory names (hex chain IDs)
+	rootfs    []string        // image rootfs paths used by containers
+}
+
+func newStoreRefs() *storeRefs {
+	return &storeRefs{blobs: map[string]bool{}, snapshots: map[string]bool{}}
+}
+
+// addImage marks the manifests, configs, layers and layer snapshots of an image.
+// Manifests whose blobs are gone are skipped, there is nothing left to keep.
+func (r *storeRefs) addImage(record *ImageRecord) {
+	for _, m := range record.Manifests {
+		data, err := readBlob(m.Digest)
+		if err != nil {
+			continue
+		}
+		r.addBlob(m.Digest)
+
+		var manifest OCIManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			continue
+		}
+		r.addBlob(manifest.Config.Digest)
+		for _, layer := range manifest.Layers {
+			r.addBlob(layer.Digest)
+		}
+
+		config, err := readImageConfig(&manifest)
+		if err != nil {
+			continue
+		}
+		chain, err := chainIDs(config.RootFS.DiffIDs)
+		if err != nil {
+			continue
+		}
+		for _, id := range chain {
+			r.snapshots[strings.TrimPrefix(id, "sha256:")] = true
+		}
+	}
+}
+
+func (r *storeRefs) addBlob(digest string) {
+	if sha256Digest.MatchString(digest) {
+		r.blobs[strings.TrimPrefix(digest, "sha256:")] = true
+	}
+}
+
+// addContainer keeps the image rootfs a container is layered on, even when its
+// image has been removed, so the container can still start
+func (r *storeRefs) addContainer(c *Container) {
+	if c.ImageRootfs == "" {
+		return
+	}
+	r.rootfs = append(r.rootfs, c.ImageRootfs)
+	if filepath.Dir(c.ImageRootfs) == filepath.Join(getLayersDir(), "sha256") {
+		r.snapshots[filepath.Base(c.ImageRootfs)] = true
+	}
+}
+
+// usedBy reports whether a container rootfs lives inside path
+func (r *storeRefs) usedBy(path string) bool {
+	for _, rootfs := range r.rootfs {
+		if rootfs == path || strings.HasPrefix(rootfs, path+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GCReport lists what a garbage collection removed
+type GCReport struct {
+	Blobs     int   `json:"blobs"`
+	Layers    int   `json:"layers"`
+	Other     int   `json:"other"` // interrupted pulls and extractions, orphaned directories
+	Reclaimed int64 `json:"reclaimed"`
+}
+
+// CollectGarbage deletes every blob and layer snapshot that no image record or
+// container refers to, together with leftovers of interrupted pulls and extractions,
+// image directories of the old per-image layout and orphaned container directories
+func CollectGarbage() (*GCReport, error) {
+	unlock, err := lockStore(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return collectGarbage()
+}
+
+// collectGarbage is CollectGarbage for callers already holding the exclusive store lock
+func collectGarbage() (*GCReport, error) {
+	records, err := ListImageRecords()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := newStoreRefs()
+	for _, record := range records {
+		refs.addImage(record)
+	}
+	for _, c := range containers {
+		refs.addContainer(c)
+	}
+
+	report := &GCReport{}
+	var garbage []string
+
+	blobsDir := filepath.Join(getBlobsDir(), "sha256")
+	for _, name := range readDirNames(blobsDir) {
+		if !refs.blobs[name] {
+			garbage = append(garbage, filepath.Join(blobsDir, name))
+			report.Blobs++
+		}
+	}
+
+	snapshotsDir := filepath.Join(getLayersDir(), "sha256")
+	for _, name := range readDirNames(snapshotsDir) {
+		if refs.snapshots[name] {
+			continue
+		}
+		garbage = append(garbage, filepath.Join(snapshotsDir, name))
+		if strings.HasPrefix(name, ".tmp-") {
+			report.Other++
+		} else {
+			report.Layers++
+		}
+	}
+
+	// Nothing holds the store lock, so no pull is still using its temporary layout
+	for _, name := range readDirNames(getTmpDir()) {
+		garbage = append(garbage, filepath.Join(getTmpDir(), name))
+		report.Other++
+	}
+
+	// Per-image directories from before the shared stores, unless a container still runs from one
+	for _, name := range readDirNames(getImagesDir()) {
+		path := filepath.Join(getImagesDir(), name)
+		if strings.HasSuffix(name, "-oci") && !refs.usedBy(path) {
+			garbage = append(garbage, path)
+			report.Other++
+		}
+	}
+
+	containerMu.Lock()
+	for _, name := range readDirNames(getContainersDir()) {
+		path := filepath.Join(getContainersDir(), name)
+		if _, err := os.Stat(filepath.Join(path, "config.json")); os.IsNotExist(err) {
+			garbage = append(garbage, path)
+			report.Other++
+		}
+	}
+	containerMu.Unlock()
+
+	report.Reclaimed = freedBytes(garbage)
+	for _, path := range garbage {
+		if err := os.RemoveAll(path); err != nil {
+			return report, fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+	}
+	return report, nil
+}
+
+func readDirNames(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+type inodeUsage struct {
+	size  int64
+	links uint64 // links seen while walking
+	nlink uint64 // links the inode has in total
+}
+
+// inodeSizes walks paths and returns every inode found once, so hardlinks shared by
+// several snapshots are only counted once. Directories that are mount points are not
+// entered (a running container's overlay would count the image again).
+func inodeSizes(paths []string) map[inodeKey]*inodeUsage {
+	inodes := map[inodeKey]*inodeUsage{}
+	for _, root := range paths {
+		rootInfo, err := os.Lstat(root)
+		if err != nil {
+			continue
+		}
+		rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				return nil
+			}
+			if info.IsDir() && stat.Dev != rootDev {
+				return filepath.SkipDir
+			}
+
+			key := inodeKey{uint64(stat.Dev), stat.Ino}
+			usage, seen := inodes[key]
+			if !seen {
+				usage = &inodeUsage{size: info.Size(), nlink: uint64(stat.Nlink)}
+				if info.IsDir() {
+					// A directory's links are its subdirectories' "..", not hardlinks
+					usage.nlink = 1
+				}
+				inodes[key] = usage
+			}
+			usage.links++
+			return nil
+		})
+	}
+	return inodes
+}
+
+func totalSize(inodes map[inodeKey]*inodeUsage) int64 {
+	var total int64
+	for _, usage := range inodes {
+		total += usage.size
+	}
+	return total
+}
+
+// freedBytes is how much removing paths gives back: inodes that still have a link
+// outside paths stay allocated
+func freedBytes(paths []string) int64 {
+	var freed int64
+	for _, usage := range inodeSizes(paths) {
+		if usage.links >= usage.nlink {
+			freed += usage.size
+		}
+	}
+	return freed
+}
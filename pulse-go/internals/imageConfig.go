@@ -0,0 +1,139 @@
+package internals
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// OCIImageConfig is the subset of the OCI image config blob that pulse uses
+type OCIImageConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Variant      string    `json:"variant,omitempty"`
+	Config       struct {
+		User       string            `json:"User"`
+		Env        []string          `json:"Env"`
+		Entrypoint []string          `json:"Entrypoint"`
+		Cmd        []string          `json:"Cmd"`
+		WorkingDir string            `json:"WorkingDir"`
+		Labels     map[string]string `json:"Labels"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// RunOverrides are the `pulse run` settings that take precedence over the image config
+type RunOverrides struct {
+	Entrypoint    []string
+	EntrypointSet bool // --entrypoint was given, even if empty
+	Cmd           []string
+	Env           []string
+	WorkingDir    string
+	User          string
+}
+
+// RunConfig is the final process configuration for a container
+type RunConfig struct {
+	Command    []string `json:"command"`
+	Env        []string `json:"env,omitempty"`
+	WorkingDir string   `json:"working_dir,omitempty"`
+	User       string   `json:"user,omitempty"`
+}
+
+// LoadImageConfig reads the config blob referenced by the manifest for platform ("" for the host)
+func LoadImageConfig(image, platform string) (*OCIImageConfig, error) {
+	target, err := ParsePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := readManifest(image, target)
+	if err != nil {
+		return nil, err
+	}
+	return readImageConfig(manifest)
+}
+
+func readImageConfig(manifest *OCIManifest) (*OCIImageConfig, error) {
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("manifest has no config descriptor")
+	}
+
+	configData, err := readBlob(manifest.Config.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image config: %v", err)
+	}
+
+	var config OCIImageConfig
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return nil, fmt.Errorf("invalid image config JSON: %v", err)
+	}
+	return &config, nil
+}
+
+// ResolveRunConfig combines the image config with the run overrides using Docker's rules:
+//   - --entrypoint replaces the image Entrypoint and discards the image Cmd
+//   - command arguments replace the Cmd
+//   - the process runs Entrypoint + Cmd
+//   - Env entries from the run flags override image Env entries with the same name
+//   - --workdir and --user replace the image WorkingDir and User
+func ResolveRunConfig(image, platform string, overrides RunOverrides) (*RunConfig, error) {
+	config, err := LoadImageConfig(image, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	entrypoint := config.Config.Entrypoint
+	cmd := config.Config.Cmd
+	if overrides.EntrypointSet {
+		entrypoint = overrides.Entrypoint
+		cmd = nil
+	}
+	if len(overrides.Cmd) > 0 {
+		cmd = overrides.Cmd
+	}
+
+	resolved := &RunConfig{
+		Command:    append(append([]string{}, entrypoint...), cmd...),
+		Env:        mergeEnv(config.Config.Env, overrides.Env),
+		WorkingDir: config.Config.WorkingDir,
+		User:       config.Config.User,
+	}
+	if overrides.WorkingDir != "" {
+		resolved.WorkingDir = overrides.WorkingDir
+	}
+	if overrides.User != "" {
+		resolved.User = overrides.User
+	}
+
+	if resolved.WorkingDir != "" && !filepath.IsAbs(resolved.WorkingDir) {
+		return nil, fmt.Errorf("working directory %q must be an absolute path", resolved.WorkingDir)
+	}
+	return resolved, nil
+}
+
+// mergeEnv returns base with entries from overrides replacing those of the same name
+func mergeEnv(base, overrides []string) []string {
+	var merged []string
+	index := map[string]int{}
+
+	for _, entry := range append(append([]string{}, base...), overrides...) {
+		name, _, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		if i, exists := index[name]; exists {
+			merged[i] = entry
+			continue
+		}
+		index[name] = len(merged)
+		merged = append(merged, entry)
+	}
+	return merged
+}
@@ -0,0 +1,345 @@
+package internals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ImageRecord is the small metadata file that ties a normalized image reference
+// (registry/repository:tag[@digest]) to manifests in the shared blob store. Blobs
+// themselves are stored once, whichever references use them; a tag is just another
+// record pointing at the same manifests.
+type ImageRecord struct {
+	Name      string          `json:"name"`
+	Manifests []ImageManifest `json:"manifests"`
+	Pulled    time.Time       `json:"pulled"`
+}
+
+// ImageManifest is the manifest pulled for one platform of an image. RepoDigest is
+// what the reference resolved to in the registry at the time: the image index of a
+// multi-platform image, otherwise the manifest itself.
+type ImageManifest struct {
+	Platform   string `json:"platform"`
+	Digest     string `json:"digest"`
+	RepoDigest string `json:"repo_digest,omitempty"`
+}
+
+// ImageSummary is one row of the images listing
+type ImageSummary struct {
+	Name       string    `json:"name"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest"`
+	RepoDigest string    `json:"repo_digest,omitempty"`
+	Platform   string    `json:"platform"`
+	Size       int64     `json:"size"` // compressed: config and layer blobs
+	Created    time.Time `json:"created"`
+}
+
+var sha256Digest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// getBlobsDir returns ~/.pulse/blobs, the OCI blob directory shared by all images
+func getBlobsDir() string {
+	blobsDir := filepath.Join(getPulseHome(), "blobs")
+	if err := os.MkdirAll(filepath.Join(blobsDir, "sha256"), 0755); err == nil {
+		fixDirOwnership(blobsDir)
+		fixDirOwnership(filepath.Join(blobsDir, "sha256"))
+	}
+	return blobsDir
+}
+
+// blobPath maps a digest to its file in the blob store. Digests come from manifests and
+// records on disk, so anything but a well-formed sha256 digest is rejected.
+func blobPath(digest string) (string, error) {
+	if !sha256Digest.MatchString(digest) {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(getBlobsDir(), "sha256", strings.TrimPrefix(digest, "sha256:")), nil
+}
+
+func readBlob(digest string) ([]byte, error) {
+	path, err := blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// imageRecordPath names the record after a hash of the normalized reference, so
+// references that differ only in characters a file name cannot hold never collide
+func imageRecordPath(image string) (string, error) {
+	name, err := NormalizeImage(image)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(getImagesDir(), hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// loadImageRecord wraps os.ErrNotExist when the image was never pulled
+func loadImageRecord(image string) (*ImageRecord, error) {
+	path, err := imageRecordPath(image)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("image %s not found locally: %w", image, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image record: %v", err)
+	}
+
+	var record ImageRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid image record for %s: %v", image, err)
+	}
+	return &record, nil
+}
+
+func saveImageRecord(record *ImageRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path, err := imageRecordPath(record.Name)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".record-*")
+	if err != nil {
+		return fmt.Errorf("failed to write image record: %v", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write image record: %v", err)
+	}
+	tmp.Close()
+	os.Chmod(tmp.Name(), 0644)
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write image record: %v", err)
+	}
+	fixDirOwnership(path)
+	return nil
+}
+
+func removeImageRecord(image string) error {
+	path, err := imageRecordPath(image)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// manifestFor returns the record's entry for platform, or nil and the platforms the
+// record does have
+func (r *ImageRecord) manifestFor(platform Platform) (*ImageManifest, []string) {
+	var available []string
+	for i, m := range r.Manifests {
+		entry, err := ParsePlatform(m.Platform)
+		if err != nil {
+			continue
+		}
+		if platform.matches(entry) {
+			return &r.Manifests[i], nil
+		}
+		available = append(available, m.Platform)
+	}
+	return nil, available
+}
+
+// imageLocks serialize updates of an image's record, e.g. by pulls of two platforms
+var imageLocks = struct {
+	sync.Mutex
+	held map[string]*imageLock
+}{held: map[string]*imageLock{}}
+
+type imageLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockImage locks the record of the normalized image name until the returned function
+// is called
+func lockImage(name string) func() {
+	imageLocks.Lock()
+	l, ok := imageLocks.held[name]
+	if !ok {
+		l = &imageLock{}
+		imageLocks.held[name] = l
+	}
+	l.users++
+	imageLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		imageLocks.Lock()
+		if l.users--; l.users == 0 {
+			delete(imageLocks.held, name)
+		}
+		imageLocks.Unlock()
+	}
+}
+
+// recordImageManifest points the image's entry for platform at digest, pulled when the
+// reference resolved to repoDigest
+func recordImageManifest(image string, platform Platform, digest, repoDigest string) error {
+	name, err := NormalizeImage(image)
+	if err != nil {
+		return err
+	}
+	defer lockImage(name)()
+
+	record, err := loadImageRecord(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		record = &ImageRecord{Name: name}
+	}
+
+	replaced := false
+	for i, m := range record.Manifests {
+		if m.Platform == platform.String() {
+			record.Manifests[i].Digest = digest
+			record.Manifests[i].RepoDigest = repoDigest
+			replaced = true
+		}
+	}
+	if !replaced {
+		record.Manifests = append(record.Manifests, ImageManifest{
+			Platform:   platform.String(),
+			Digest:     digest,
+			RepoDigest: repoDigest,
+		})
+	}
+	record.Pulled = time.Now().UTC()
+	return saveImageRecord(record)
+}
+
+// ListImageRecords returns all image references, sorted by name
+func ListImageRecords() ([]*ImageRecord, error) {
+	entries, err := os.ReadDir(getImagesDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*ImageRecord
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(getImagesDir(), entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var record ImageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			continue
+		}
+		records = append(records, &record)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records, nil
+}
+
+// ListImages returns one row per reference and platform, with the details read from
+// the manifest and image config
+func ListImages() ([]ImageSummary, error) {
+	records, err := ListImageRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []ImageSummary
+	for _, record := range records {
+		repository, tag, _ := splitReference(record.Name)
+		for _, m := range record.Manifests {
+			summary := ImageSummary{
+				Name:       record.Name,
+				Repository: repository,
+				Tag:        tag,
+				Digest:     m.Digest,
+				RepoDigest: m.RepoDigest,
+				Platform:   m.Platform,
+			}
+
+			if data, err := readBlob(m.Digest); err == nil {
+				var manifest OCIManifest
+				if json.Unmarshal(data, &manifest) == nil {
+					summary.Size = manifest.Config.Size
+					for _, layer := range manifest.Layers {
+						summary.Size += layer.Size
+					}
+					if config, err := readImageConfig(&manifest); err == nil {
+						summary.Created = config.Created
+					}
+				}
+			}
+			images = append(images, summary)
+		}
+	}
+	return images, nil
+}
+
+// TagImage makes target refer to the same manifests as source, replacing whatever
+// target referred to before. The shared store lock keeps garbage collection from
+// removing the source's blobs until the new record points at them.
+func TagImage(source, target string) error {
+	unlock, err := lockStore(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record, err := loadImageRecord(source)
+	if err != nil {
+		return err
+	}
+
+	name, err := NormalizeImage(target)
+	if err != nil {
+		return err
+	}
+	defer lockImage(name)()
+
+	tagged := &ImageRecord{
+		Name:      name,
+		Manifests: record.Manifests,
+		Pulled:    record.Pulled,
+	}
+	return saveImageRecord(tagged)
+}
+
+// UntagImage removes a reference. Containers keep their layers; blobs that no other
+// reference uses are garbage-collected.
+func UntagImage(image string) error {
+	if _, err := loadImageRecord(image); err != nil {
+		return err
+	}
+	if err := removeImageRecord(image); err != nil {
+		return fmt.Errorf("failed to untag %s: %v", image, err)
+	}
+	if _, err := CollectGarbage(); err != nil {
+		return fmt.Errorf("untagged %s, but cleaning up its layers failed: %v", image, err)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package internals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageStoreVersion is the on-disk format of the image store that this pulse writes.
+// Each format change adds a step to migrateSteps.
+const imageStoreVersion = 2
+
+// migrateSteps[i] brings a store at version i up to version i+1, returning notes on
+// what it changed for the daemon to print
+var migrateSteps = []func() ([]string, error){
+	normalizeImageRecords,
+	importLegacyLayouts,
+}
+
+func imageStoreVersionPath() string {
+	return filepath.Join(getImagesDir(), "store-version")
+}
+
+// MigrateImageStore upgrades an image store written by an older pulse and returns
+// notes on what it changed. The daemon runs it once at start; listing and looking up
+// images never rewrite the store.
+func MigrateImageStore() ([]string, error) {
+	unlock, err := lockStore(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	version := 0
+	if data, err := os.ReadFile(imageStoreVersionPath()); err == nil {
+		if version, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return nil, fmt.Errorf("invalid image store version %q", data)
+		}
+	}
+	if version > imageStoreVersion {
+		return nil, fmt.Errorf("image store version %d is newer than this pulse supports (%d)", version, imageStoreVersion)
+	}
+
+	var notes []string
+	for ; version < imageStoreVersion; version++ {
+		stepNotes, err := migrateSteps[version]()
+		notes = append(notes, stepNotes...)
+		if err != nil {
+			return notes, fmt.Errorf("failed to migrate image store to version %d: %v", version+1, err)
+		}
+		path := imageStoreVersionPath()
+		if err := os.WriteFile(path, []byte(strconv.Itoa(version+1)+"\n"), 0644); err != nil {
+			return notes, fmt.Errorf("failed to record image store version: %v", err)
+		}
+		fixDirOwnership(path)
+	}
+	return notes, nil
+}
+
+// normalizeImageRecords rekeys records written before references were normalized,
+// which are named after the reference as typed. Where a record for the normalized
+// reference exists too, it was pulled later and wins.
+func normalizeImageRecords() ([]string, error) {
+	entries, err := os.ReadDir(getImagesDir())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(getImagesDir(), entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var record ImageRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			// Not ours to fix; listing skips it as before
+			continue
+		}
+
+		expected, err := imageRecordPath(record.Name)
+		if err != nil || expected == path {
+			continue
+		}
+		if _, err := os.Stat(expected); os.IsNotExist(err) {
+			record.Name, _ = NormalizeImage(record.Name)
+			if err := saveImageRecord(&record); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// importLegacyLayouts moves images out of the per-image OCI layouts of older versions,
+// ~/.pulse/images/<name>-oci, into the shared blob store and image records. The layout
+// is then removed, unless a container still runs from a rootfs extracted inside it;
+// garbage collection removes those once the container is gone. A layout that cannot
+// be read is reported and left for garbage collection too.
+func importLegacyLayouts() ([]string, error) {
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+	refs := newStoreRefs()
+	for _, c := range containers {
+		refs.addContainer(c)
+	}
+
+	var notes []string
+	for _, dirName := range readDirNames(getImagesDir()) {
+		if !strings.HasSuffix(dirName, "-oci") {
+			continue
+		}
+		layout := filepath.Join(getImagesDir(), dirName)
+		if _, err := os.Stat(filepath.Join(layout, "index.json")); err != nil {
+			continue
+		}
+
+		name := legacyImageName(dirName, containers)
+		if err := importLegacyLayout(layout, name); err != nil {
+			notes = append(notes, fmt.Sprintf("could not move %s to the shared image store: %v", dirName, err))
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("moved %s to the shared image store as %s", dirName, FamiliarImage(name)))
+
+		if !refs.usedBy(layout) {
+			if err := os.RemoveAll(layout); err != nil {
+				return notes, err
+			}
+		}
+	}
+	return notes, nil
+}
+
+func importLegacyLayout(layout, name string) error {
+	blobsDir := filepath.Join(layout, "blobs", "sha256")
+	for _, hexDigest := range readDirNames(blobsDir) {
+		if err := importBlob(filepath.Join(blobsDir, hexDigest), "sha256:"+hexDigest); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return err
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("invalid index.json")
+	}
+	manifests, err := legacyManifests(index.Manifests, 0)
+	if err != nil {
+		return err
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("no image manifests in index.json")
+	}
+
+	// An image pulled again since the upgrade already has a newer record
+	if _, err := loadImageRecord(name); err == nil {
+		return nil
+	}
+	record := &ImageRecord{Name: name, Manifests: manifests, Pulled: legacyPullTime(layout)}
+	return saveImageRecord(record)
+}
+
+// legacyPullTime is when the layout was last pulled into: what pulse-image.json says,
+// for layouts of versions that wrote it next to index.json, else when index.json changed.
+// Its platform list is not needed, the manifests in the index carry their platforms.
+func legacyPullTime(layout string) time.Time {
+	var meta struct {
+		Pulled time.Time `json:"pulled"`
+	}
+	if data, err := os.ReadFile(filepath.Join(layout, "pulse-image.json")); err == nil {
+		if json.Unmarshal(data, &meta) == nil && !meta.Pulled.IsZero() {
+			return meta.Pulled.UTC()
+		}
+	}
+	if info, err := os.Stat(filepath.Join(layout, "index.json")); err == nil {
+		return info.ModTime().UTC()
+	}
+	return time.Time{}
+}
+
+// importBlob links (or copies) a blob of a legacy layout into the blob store, after
+// checking it still matches its digest. Corrupt blobs are left behind, the way an
+// interrupted pull leaves nothing.
+func importBlob(src, digest string) error {
+	dst, err := blobPath(digest)
+	if err != nil {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		return nil
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	// Different filesystems, or a filesystem without hardlinks
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(getTmpDir(), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy blob %s: %v", digest, err)
+	}
+	tmp.Close()
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), dst)
+}
+
+// legacyManifests lists the image manifests of an index by platform, descending into
+// nested indexes. Entries without a platform get the one in their image config.
+func legacyManifests(descriptors []OCIDescriptor, depth int) ([]ImageManifest, error) {
+	if depth > maxIndexDepth {
+		return nil, fmt.Errorf("image indexes nested too deeply")
+	}
+
+	var manifests []ImageManifest
+	for _, desc := range descriptors {
+		data, err := readBlob(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %s: %v", desc.Digest, err)
+		}
+		var blob struct {
+			OCIIndex
+			OCIManifest
+		}
+		if err := json.Unmarshal(data, &blob); err != nil {
+			return nil, fmt.Errorf("invalid manifest JSON: %v", err)
+		}
+
+		if blob.Manifests != nil {
+			nested, err := legacyManifests(blob.Manifests, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, nested...)
+			continue
+		}
+
+		var platform Platform
+		if desc.Platform != nil {
+			platform = *desc.Platform
+		} else {
+			config, err := readImageConfig(&blob.OCIManifest)
+			if err != nil {
+				return nil, err
+			}
+			platform = Platform{OS: config.OS, Architecture: config.Architecture, Variant: config.Variant}
+		}
+		// Attestations are labelled unknown/unknown and cannot be run
+		if platform.OS == "unknown" {
+			continue
+		}
+		manifests = append(manifests, ImageManifest{Platform: platform.normalize().String(), Digest: desc.Digest})
+	}
+	return manifests, nil
+}
+
+// legacyImageName recovers the reference a legacy layout was pulled as. Its directory
+// name had both "/" and ":" replaced by "_", so a container created from the image,
+// which records the name as typed, is asked first. Otherwise a last part that looks
+// like a version or "latest" is taken as the tag and the other "_" as "/".
+func legacyImageName(dirName string, containers []*Container) string {
+	base := strings.TrimSuffix(dirName, "-oci")
+	flatten := strings.NewReplacer("/", "_", ":", "_")
+	for _, c := range containers {
+		if flatten.Replace(c.Image) == base {
+			if name, err := NormalizeImage(c.Image); err == nil {
+				return name
+			}
+		}
+	}
+
+	var guess string
+	if i := strings.LastIndexByte(base, '_'); i > 0 && legacyTag.MatchString(base[i+1:]) {
+		guess = strings.ReplaceAll(base[:i], "_", "/") + ":" + base[i+1:]
+	} else {
+		guess = strings.ReplaceAll(base, "_", "/")
+	}
+	if name, err := NormalizeImage(guess); err == nil {
+		return name
+	}
+	if name, err := NormalizeImage(base); err == nil {
+		return name
+	}
+	// Still listed and removable, under a name made from the directory
+	slug := strings.Trim(strings.ToLower(legacyUnsafe.ReplaceAllString(base, "-")), "-")
+	if slug == "" {
+		slug = "unnamed"
+	}
+	return "localhost/legacy/" + slug + ":latest"
+}
+
+var (
+	legacyTag    = regexp.MustCompile(`^(latest|v?[0-9][A-Za-z0-9_.-]*)$`)
+	legacyUnsafe = regexp.MustCompile(`[^A-Za-z0-9]+`)
+)
@@ -0,0 +1,200 @@
+package internals
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extracted layers are cached as snapshots under ~/.pulse/layers/sha256/<chain-id>.
+// A snapshot is the filesystem after applying a layer on top of its parent snapshot,
+// and is keyed by the OCI ChainID of the diff_ids below it, so images that share
+// base layers share their snapshots. A snapshot hardlinks every non-directory entry
+// of its parent instead of copying it.
+
+func getLayersDir() string {
+	layersDir := filepath.Join(getPulseHome(), "layers")
+	if err := os.MkdirAll(filepath.Join(layersDir, "sha256"), 0755); err == nil {
+		fixDirOwnership(layersDir)
+		fixDirOwnership(filepath.Join(layersDir, "sha256"))
+	}
+	return layersDir
+}
+
+func snapshotPath(chainID string) string {
+	return filepath.Join(getLayersDir(), "sha256", strings.TrimPrefix(chainID, "sha256:"))
+}
+
+// chainIDs computes ChainID(L0) = DiffID(L0) and
+// ChainID(L0|...|Ln) = sha256(ChainID(L0|...|Ln-1) + " " + DiffID(Ln))
+func chainIDs(diffIDs []string) ([]string, error) {
+	chain := make([]string, len(diffIDs))
+	for i, diffID := range diffIDs {
+		if !sha256Digest.MatchString(diffID) {
+			return nil, fmt.Errorf("unsupported diff_id %q", diffID)
+		}
+		if i == 0 {
+			chain[i] = diffID
+			continue
+		}
+		sum := sha256.Sum256([]byte(chain[i-1] + " " + diffID))
+		chain[i] = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return chain, nil
+}
+
+// applyLayers returns the snapshot of the whole layer stack, extracting only the
+// layers above the deepest snapshot that is already cached
+func applyLayers(layers []OCIDescriptor, diffIDs []string) (string, error) {
+	chain, err := chainIDs(diffIDs)
+	if err != nil {
+		return "", err
+	}
+
+	parent := ""
+	start := 0
+	for i := len(chain) - 1; i >= 0; i-- {
+		if _, err := os.Stat(snapshotPath(chain[i])); err == nil {
+			parent = snapshotPath(chain[i])
+			start = i + 1
+			break
+		}
+	}
+
+	for i := start; i < len(chain); i++ {
+		snapshot, err := createSnapshot(parent, layers[i], diffIDs[i], chain[i])
+		if err != nil {
+			return "", fmt.Errorf("failed to extract layer %s: %v", strings.TrimPrefix(layers[i].Digest, "sha256:"), err)
+		}
+		parent = snapshot
+	}
+	return parent, nil
+}
+
+// createSnapshot builds the snapshot in a temporary directory and renames it into
+// place, so a snapshot that exists is always complete
+func createSnapshot(parent string, layer OCIDescriptor, diffID, chainID string) (string, error) {
+	layerPath, err := blobPath(layer.Digest)
+	if err != nil {
+		return "", err
+	}
+
+	final := snapshotPath(chainID)
+	tmp, err := os.MkdirTemp(filepath.Dir(final), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	os.Chmod(tmp, 0755)
+
+	if parent != "" {
+		if err := linkTree(parent, tmp); err != nil {
+			return "", fmt.Errorf("failed to link parent layer: %v", err)
+		}
+	}
+
+	if err := extractLayer(layerPath, layer, diffID, tmp); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		// Another extraction of the same layer finished first
+		if _, statErr := os.Stat(final); statErr == nil {
+			return final, nil
+		}
+		return "", err
+	}
+	return final, nil
+}
+
+// linkTree recreates the directories of src in dst and hardlinks everything else.
+// Extraction never writes through an existing file (entries are removed and
+// recreated), so applying a layer to the copy leaves src untouched.
+func linkTree(src, dst string) error {
+	type dirAttrs struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dirAttrs
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if !info.IsDir() {
+			return os.Link(path, target)
+		}
+
+		if rel != "." {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+		}
+		copyXattrs(path, target)
+		dirs = append(dirs, dirAttrs{target, info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Deepest first, creating entries would change a parent's times
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path, info := dirs[i].path, dirs[i].info
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+		if os.Geteuid() == 0 {
+			os.Lchown(path, int(stat.Uid), int(stat.Gid))
+		}
+		os.Chmod(path, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+		unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{
+			unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+			unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+		}, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	return nil
+}
+
+// copyXattrs copies what extended attributes can be read and set; privileged
+// namespaces fail without root, which is the same as extraction skipping them
+func copyXattrs(src, dst string) {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size <= 0 {
+		return
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(src, buf)
+	if err != nil {
+		return
+	}
+
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = unix.Lgetxattr(src, name, value); err != nil {
+			continue
+		}
+		unix.Lsetxattr(dst, name, value[:valueSize], 0)
+	}
+}
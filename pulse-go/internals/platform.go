@@ -0,0 +1,85 @@
+package internals
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform identifies one entry of a multi-platform image, e.g. linux/arm64/v8
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// HostPlatform is the platform pulse itself runs on
+func HostPlatform() Platform {
+	return Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}.normalize()
+}
+
+// ParsePlatform parses os/arch[/variant]; an empty string selects the host platform
+func ParsePlatform(s string) (Platform, error) {
+	if s == "" {
+		return HostPlatform(), nil
+	}
+
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p.normalize(), nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// normalize applies the same aliases and default variants as the OCI platform matchers,
+// so linux/aarch64 and linux/arm64/v8 are the same platform
+func (p Platform) normalize() Platform {
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	case "i386", "i686":
+		p.Architecture = "386"
+	}
+
+	switch p.Architecture {
+	case "arm64":
+		if p.Variant == "" || p.Variant == "8" {
+			p.Variant = "v8"
+		}
+	case "arm":
+		if p.Variant == "" {
+			p.Variant = "v7"
+		} else if !strings.HasPrefix(p.Variant, "v") {
+			p.Variant = "v" + p.Variant
+		}
+	case "amd64":
+		if p.Variant == "v1" {
+			p.Variant = ""
+		}
+	}
+	return p
+}
+
+// matches reports whether an image entry for other can run as p
+func (p Platform) matches(other Platform) bool {
+	other = other.normalize()
+	return p.OS == other.OS && p.Architecture == other.Architecture && p.Variant == other.Variant
+}
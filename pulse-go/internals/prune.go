@@ -0,0 +1,294 @@
+package internals
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PruneFilters are the parsed `--filter` flags of the prune commands
+type PruneFilters struct {
+	Until     time.Time         // only objects created before this time
+	Labels    map[string]string // label=key or label=key=value ("" matches any value)
+	NotLabels map[string]string // label!=key or label!=key=value
+}
+
+// ParsePruneFilters accepts until=<duration|timestamp>, label=<key>[=<value>] and
+// label!=<key>[=<value>], like Docker
+func ParsePruneFilters(filters []string) (*PruneFilters, error) {
+	parsed := &PruneFilters{Labels: map[string]string{}, NotLabels: map[string]string{}}
+
+	for _, filter := range filters {
+		if value, ok := strings.CutPrefix(filter, "label!="); ok {
+			key, val, _ := strings.Cut(value, "=")
+			parsed.NotLabels[key] = val
+			continue
+		}
+
+		name, value, ok := strings.Cut(filter, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %q, expected name=value", filter)
+		}
+		switch name {
+		case "until":
+			until, err := parseUntil(value)
+			if err != nil {
+				return nil, err
+			}
+			parsed.Until = until
+		case "label":
+			key, val, _ := strings.Cut(value, "=")
+			parsed.Labels[key] = val
+		default:
+			return nil, fmt.Errorf("invalid filter %q", name)
+		}
+	}
+	return parsed, nil
+}
+
+func parseUntil(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid until filter %q, expected a duration or timestamp", value)
+}
+
+func (f *PruneFilters) matches(created time.Time, labels map[string]string) bool {
+	if !f.Until.IsZero() && !created.Before(f.Until) {
+		return false
+	}
+	for key, want := range f.Labels {
+		got, ok := labels[key]
+		if !ok || (want != "" && got != want) {
+			return false
+		}
+	}
+	for key, unwanted := range f.NotLabels {
+		got, ok := labels[key]
+		if ok && (unwanted == "" || got == unwanted) {
+			return false
+		}
+	}
+	return true
+}
+
+// PruneReport lists what a prune removed and how much space it gave back
+type PruneReport struct {
+	Deleted   []string  `json:"deleted"`
+	GC        *GCReport `json:"gc,omitempty"`
+	Reclaimed int64     `json:"reclaimed"`
+}
+
+// PruneImages removes dangling images (records whose manifests are gone), or with all
+// every image no container uses, then garbage-collects the blobs and layers they held.
+// The store stays locked from the scan to the last removal, so no pull or new container
+// can start using an image in between.
+func PruneImages(all bool, filters *PruneFilters) (*PruneReport, error) {
+	unlock, err := lockStore(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records, err := ListImageRecords()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{}
+	for _, record := range records {
+		if imageUsed(record, containers) {
+			continue
+		}
+
+		labels, dangling := imageLabels(record)
+		if !dangling && !all {
+			continue
+		}
+		if !filters.matches(record.Pulled, labels) {
+			continue
+		}
+
+		if err := removeImageRecord(record.Name); err != nil {
+			return report, fmt.Errorf("failed to remove image %s: %v", record.Name, err)
+		}
+		report.Deleted = append(report.Deleted, record.Name)
+	}
+
+	gc, err := collectGarbage()
+	if err != nil {
+		return report, err
+	}
+	report.GC = gc
+	report.Reclaimed = gc.Reclaimed
+	return report, nil
+}
+
+func imageUsed(record *ImageRecord, containers []*Container) bool {
+	rootfs := imageRootfsPaths(record)
+	for _, c := range containers {
+		if usesImage(c, record, rootfs) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageLabels returns the config labels of an image's manifests; an image none of whose
+// manifests can be read is dangling
+func imageLabels(record *ImageRecord) (map[string]string, bool) {
+	labels := map[string]string{}
+	dangling := true
+
+	for _, m := range record.Manifests {
+		entry, err := ParsePlatform(m.Platform)
+		if err != nil {
+			continue
+		}
+		manifest, err := readManifest(record.Name, entry)
+		if err != nil {
+			continue
+		}
+		config, err := readImageConfig(manifest)
+		if err != nil {
+			continue
+		}
+		dangling = false
+		for key, value := range config.Config.Labels {
+			labels[key] = value
+		}
+	}
+	return labels, dangling
+}
+
+// PruneContainers removes every container that is not running. Containers have no
+// labels of their own, they are matched on their image's labels.
+func PruneContainers(filters *PruneFilters) (*PruneReport, error) {
+	unlock, err := lockStore(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &PruneReport{}
+	for _, c := range containers {
+		if c.State == StateRunning {
+			continue
+		}
+
+		labels := map[string]string{}
+		if record, err := loadImageRecord(c.Image); err == nil {
+			labels, _ = imageLabels(record)
+		}
+		if !filters.matches(c.Created, labels) {
+			continue
+		}
+
+		// Starting a container does not take the store lock, so check it is still stopped
+		current, err := LoadContainer(c.ID)
+		if err != nil || current.State == StateRunning {
+			continue
+		}
+
+		size := freedBytes([]string{containerDir(c.ID)})
+		if err := RemoveContainer(current); err != nil {
+			return report, err
+		}
+		report.Deleted = append(report.Deleted, c.ID)
+		report.Reclaimed += size
+	}
+	return report, nil
+}
+
+// DiskUsageRow is one line of `pulse system df`
+type DiskUsageRow struct {
+	Type        string `json:"type"`
+	Total       int    `json:"total"`
+	Active      int    `json:"active"`
+	Size        int64  `json:"size"`
+	Reclaimable int64  `json:"reclaimable"`
+}
+
+// SystemDiskUsage splits the space pulse uses into images (blobs and extracted layers),
+// containers (writable layers and logs) and volumes. Files hardlinked between layer
+// snapshots are counted once.
+func SystemDiskUsage() ([]DiskUsageRow, error) {
+	records, err := ListImageRecords()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := ListContainers(true)
+	if err != nil {
+		return nil, err
+	}
+
+	activeRefs := newStoreRefs()
+	for _, c := range containers {
+		activeRefs.addContainer(c)
+	}
+
+	allRefs := newStoreRefs()
+	images := DiskUsageRow{Type: "Images", Total: len(records)}
+	for _, record := range records {
+		allRefs.addImage(record)
+		if imageUsed(record, containers) {
+			images.Active++
+			activeRefs.addImage(record)
+		}
+	}
+
+	all := inodeSizes(refPaths(allRefs))
+	active := inodeSizes(refPaths(activeRefs))
+	images.Size = totalSize(all)
+	for key, usage := range all {
+		if _, ok := active[key]; !ok {
+			images.Reclaimable += usage.size
+		}
+	}
+
+	ctrs := DiskUsageRow{Type: "Containers", Total: len(containers)}
+	for _, c := range containers {
+		size := totalSize(inodeSizes([]string{containerDir(c.ID)}))
+		ctrs.Size += size
+		if c.State == StateRunning {
+			ctrs.Active++
+		} else {
+			ctrs.Reclaimable += size
+		}
+	}
+
+	// pulse has no volumes yet; the row keeps the report in Docker's shape
+	volumes := DiskUsageRow{Type: "Local Volumes"}
+
+	return []DiskUsageRow{images, ctrs, volumes}, nil
+}
+
+func refPaths(refs *storeRefs) []string {
+	var paths []string
+	blobsDir := filepath.Join(getBlobsDir(), "sha256")
+	for name := range refs.blobs {
+		paths = append(paths, filepath.Join(blobsDir, name))
+	}
+	snapshotsDir := filepath.Join(getLayersDir(), "sha256")
+	for name := range refs.snapshots {
+		paths = append(paths, filepath.Join(snapshotsDir, name))
+	}
+	return paths
+}
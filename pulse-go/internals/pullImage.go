@@ -2,9 +2,9 @@ package internals
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -12,95 +12,316 @@ import (
 	"strings"
 
 	"github.com/containers/image/v5/copy"
-	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
 )
 
-func PullImage(image string, w io.Writer, flusher http.Flusher) (string, error) {
-	ctx := context.Background()
-	fmt.Fprintf(w, "⬇️ Pulling image: %s\n", image)
-	flusher.Flush()
-
-	localDir := filepath.Join(getImagesDir(), fmt.Sprintf("%s-oci", sanitize(image)))
-	manifestPath := filepath.Join(localDir, "index.json")
-	if _, err := os.Stat(manifestPath); err == nil {
-		msg := fmt.Sprintf("✅ Image %s already available locally. Skipping pull.\n", image)
-		fmt.Fprint(w, msg)
-		flusher.Flush()
+// PullOptions tune a pull
+type PullOptions struct {
+	Platform string     // "" for the host platform
+	Always   bool       // ask the registry where the tag points now, even if the image is local
+	User     *user.User // whose registry credentials to use; nil for the user running pulse
+	// RequirePolicy fails the pull when there is no signature policy instead of
+	// accepting the image unverified
+	RequirePolicy bool
+}
+
+// PullImage copies image into the shared blob store and records its manifest.
+// opts.Platform selects the entry of a multi-platform image; other platforms of the
+// same image can be pulled later and are recorded side by side. A tag is first
+// resolved to a digest and the pull is pinned to it, so what is recorded is exactly
+// what the registry served. Blobs that are already in the store are not downloaded
+// again. Each step, including the download of every blob, is reported to progress.
+//
+// Cancelling ctx stops the pull wherever it is. Blobs that finished downloading stay
+// in the store, so pulling again only fetches the rest; partial downloads are removed.
+func PullImage(ctx context.Context, image string, opts PullOptions, progress PullProgress) (string, error) {
+	if progress == nil {
+		progress = func(PullEvent) {}
+	}
+
+	target, err := ParsePlatform(opts.Platform)
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	named, err := ParseImageReference(image)
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	_, byDigest := named.(reference.Digested)
+
+	progress.message(PullStatusPulling, "⬇️ Pulling image: %s (%s)", image, target)
+
+	// Content behind a digest never changes; a tag is only looked up again with Always
+	local := localManifest(named.String(), target)
+	if local != nil && (byDigest || !opts.Always) {
+		msg := fmt.Sprintf("✅ Image %s (%s) already available locally. Skipping pull.", image, target)
+		progress(PullEvent{Status: PullStatusDone, Message: msg, Digest: local.resolvedDigest()})
 		return msg, nil
 	}
 
-	fmt.Fprintf(w, "Pulling image from Docker registry...\n")
-	flusher.Flush()
+	unlock, err := lockStore(false)
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	defer unlock()
+
+	conf, err := LoadRegistriesConfig()
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	sigStorage, err := os.MkdirTemp(getTmpDir(), "registries.d-")
+	if err != nil {
+		return progress.fail(ctx, fmt.Errorf("failed to create signature configuration: %v", err))
+	}
+	defer os.RemoveAll(sigStorage)
+	if err := conf.writeSignatureStorage(sigStorage); err != nil {
+		return progress.fail(ctx, err)
+	}
 
-	// Try to load system policy, fallback if missing
-	policy, err := signature.DefaultPolicy(nil)
+	sources, err := conf.pullSources(&types.SystemContext{
+		OSChoice:           target.OS,
+		ArchitectureChoice: target.Architecture,
+		VariantChoice:      target.Variant,
+		RegistriesDirPath:  sigStorage,
+	}, named)
 	if err != nil {
-		fmt.Fprintf(w, "⚠️ No system policy found, using insecure fallback.\n")
-		flusher.Flush()
+		return progress.fail(ctx, err)
+	}
+	for i, src := range sources {
+		sources[i].sys, err = registryContext(src.sys, opts.User, src.named)
+		if err != nil {
+			return progress.fail(ctx, err)
+		}
+	}
 
-		policy = &signature.Policy{
-			Default: []signature.PolicyRequirement{
-				signature.NewPRInsecureAcceptAnything(),
-			},
+	repoDigest, first, err := resolveFromSources(ctx, sources, progress)
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	if local != nil && local.RepoDigest == repoDigest {
+		msg := fmt.Sprintf("✅ Image %s (%s) is up to date", image, target)
+		progress(PullEvent{Status: PullStatusDone, Message: msg, Digest: repoDigest})
+		return msg, nil
+	}
+
+	progress.message(PullStatusInfo, "Pulling image from %s...", reference.Domain(named))
+
+	policy, err := LoadSignaturePolicy()
+	if errors.Is(err, ErrNoSignaturePolicy) && !opts.RequirePolicy {
+		progress.message(PullStatusWarning, "⚠️ %v, the image is not verified", err)
+		policy, err = insecurePolicy(), nil
+	}
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	imgPolicy, err := policy.forImage(named)
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	defer imgPolicy.Destroy()
+
+	// Every source is asked for the same digest, so a mirror that falls over halfway
+	// can be replaced by the next one without mixing images
+	var digest string
+	for _, src := range sources[first:] {
+		if src.mirror {
+			progress.message(PullStatusInfo, "Pulling from mirror %s", reference.Domain(src.named))
+		}
+		digest, err = copyPinned(ctx, imgPolicy, src, repoDigest, target, progress)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		if src.mirror {
+			progress.message(PullStatusWarning, "⚠️ Mirror %s failed: %v", reference.Domain(src.named), err)
+		}
+	}
+	if err != nil {
+		return progress.fail(ctx, err)
+	}
+	if err := recordImageManifest(named.String(), target, digest, repoDigest); err != nil {
+		return progress.fail(ctx, err)
+	}
+
+	msg := fmt.Sprintf("✅ Successfully pulled image: %s", image)
+	progress(PullEvent{Status: PullStatusDone, Message: msg, Digest: repoDigest})
+	return msg, nil
+}
+
+// resolveFromSources resolves the reference on the first source that answers and
+// returns the digest and that source's index
+func resolveFromSources(ctx context.Context, sources []pullSource, progress PullProgress) (string, int, error) {
+	var err error
+	for i, src := range sources {
+		var digest string
+		digest, err = resolveDigest(ctx, src.sys, src.named)
+		if err == nil {
+			return digest, i, nil
+		}
+		if ctx.Err() != nil {
+			break
 		}
+		if src.mirror {
+			progress.message(PullStatusWarning, "⚠️ Mirror %s failed: %v", reference.Domain(src.named), err)
+		}
+	}
+	return "", 0, err
+}
+
+// copyPinned checks the image with repoDigest at src against the signature policy,
+// copies it into the shared blob store and returns the digest of the manifest for
+// platform
+func copyPinned(ctx context.Context, policy *imagePolicy, src pullSource, repoDigest string, platform Platform, progress PullProgress) (string, error) {
+	// Copy by digest so a tag moving during the pull cannot mix two images
+	pinned, err := pinnedReference(src.named, repoDigest)
+	if err != nil {
+		return "", err
 	}
 
-	policyCtx, err := signature.NewPolicyContext(policy)
+	decision, err := policy.check(ctx, src, pinned)
 	if err != nil {
-		return "", fmt.Errorf("failed to create policy context: %v", err)
+		return "", fmt.Errorf("failed to check signatures: %v", err)
+	}
+	progress(PullEvent{Status: PullStatusPolicy, Message: decision.String(), Policy: decision})
+	if !decision.Accepted {
+		return "", fmt.Errorf("image rejected by signature policy: %s", decision.Requirement)
 	}
-	defer policyCtx.Destroy()
 
-	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", image))
+	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", pinned))
 	if err != nil {
 		return "", fmt.Errorf("invalid image name: %v", err)
 	}
 
-	destPath := filepath.Join(getImagesDir(), fmt.Sprintf("%s-oci", sanitize(image)))
-	if err := os.MkdirAll(destPath, 0755); err != nil {
+	// The pull goes through a throwaway OCI layout whose blobs live in the shared
+	// store. Blobs are downloaded into the layout and renamed into the store once
+	// complete, so removing it discards index.json and any partial downloads, whether
+	// the copy failed or was cancelled.
+	destPath, err := os.MkdirTemp(getTmpDir(), "pull-")
+	if err != nil {
 		return "", fmt.Errorf("failed to create destination: %v", err)
 	}
+	defer os.RemoveAll(destPath)
 
 	destRef, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s", destPath))
 	if err != nil {
 		return "", fmt.Errorf("invalid destination path: %v", err)
 	}
 
-	systemCtx := &types.SystemContext{
-		DockerInsecureSkipTLSVerify: types.NewOptionalBool(true),
-	}
+	destCtx := *src.sys
+	destCtx.OCISharedBlobDirPath = getBlobsDir()
 
-	progress := func(format string, args ...interface{}) {
-		fmt.Fprintf(w, format+"\n", args...)
-		flusher.Flush()
-	}
+	// copy.Image is done sending once it returns, then the reporter drains and exits
+	events := make(chan types.ProgressProperties)
+	reported := make(chan struct{})
+	go func() {
+		progress.reportBlobs(ctx, events)
+		close(reported)
+	}()
 
-	_, err = copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
-		SourceCtx:      systemCtx,
-		DestinationCtx: systemCtx,
-		ReportWriter: writerFunc(func(msg string, args ...interface{}) {
-			fmt.Fprintf(w, msg, args...)
-			flusher.Flush()
-		}),
+	_, err = copy.Image(ctx, policy.ctx, destRef, srcRef, &copy.Options{
+		SourceCtx:        src.sys,
+		DestinationCtx:   &destCtx,
+		Progress:         events,
+		ProgressInterval: progressInterval,
+		// Signatures are verified against the source; the OCI layout cannot hold them
+		RemoveSignatures: true,
 	})
+	close(events)
+	<-reported
 	if err != nil {
-		progress("❌ Pull failed: %v", err)
-		os.RemoveAll(destPath)
 		return "", err
 	}
 
-	msg := fmt.Sprintf("✅ Successfully pulled image: %s", image)
-	progress(msg)
-	return msg, nil
+	// Single-platform images are copied regardless of the choice, so check what arrived
+	return pulledManifest(destPath, platform)
 }
 
-type writerFunc func(string, ...interface{})
+// localManifest returns the image's entry for platform if its manifest is in the store
+func localManifest(image string, platform Platform) *ImageManifest {
+	record, err := loadImageRecord(image)
+	if err != nil {
+		return nil
+	}
+	m, _ := record.manifestFor(platform)
+	if m == nil {
+		return nil
+	}
+	if _, err := readBlob(m.Digest); err != nil {
+		return nil
+	}
+	return m
+}
 
-func (fn writerFunc) Write(p []byte) (n int, err error) {
-	fn("%s", string(p))
-	return len(p), nil
+// resolvedDigest is the digest the reference resolved to; records from before digests
+// were pinned only know the platform manifest
+func (m *ImageManifest) resolvedDigest() string {
+	if m.RepoDigest != "" {
+		return m.RepoDigest
+	}
+	return m.Digest
+}
+
+// resolveDigest returns the digest a reference points to: the digest itself for
+// name@digest, otherwise whatever the registry currently serves for the tag
+func resolveDigest(ctx context.Context, sys *types.SystemContext, named reference.Named) (string, error) {
+	if digested, ok := named.(reference.Digested); ok {
+		return digested.Digest().String(), nil
+	}
+
+	ref, err := docker.NewReference(named)
+	if err != nil {
+		return "", fmt.Errorf("invalid image name: %v", err)
+	}
+	digest, err := docker.GetDigest(ctx, sys, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %v", reference.FamiliarString(named), err)
+	}
+	return digest.String(), nil
+}
+
+// pinnedReference returns repository@digest for named. A tag is dropped: the registry
+// API takes one or the other, and name:tag@digest means the digest anyway.
+func pinnedReference(named reference.Named, repoDigest string) (string, error) {
+	pinned, err := reference.ParseNormalizedNamed(reference.TrimNamed(named).String() + "@" + repoDigest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %q: %v", repoDigest, err)
+	}
+	return pinned.String(), nil
+}
+
+// pulledManifest returns the digest of the manifest for platform in a pull's layout
+func pulledManifest(layoutDir string, platform Platform) (string, error) {
+	indexData, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read index.json: %v", err)
+	}
+
+	var index OCIIndex
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return "", fmt.Errorf("invalid index.json")
+	}
+
+	var available []string
+	manifest, digest, err := findManifest(index.Manifests, platform, &available, 0)
+	if err != nil {
+		return "", err
+	}
+	if manifest == nil {
+		return "", fmt.Errorf("no manifest for platform %s (available: %s)", platform, strings.Join(available, ", "))
+	}
+	return digest, nil
+}
+
+// getTmpDir holds in-progress pulls; it is on the same filesystem as the stores so
+// finished files can be renamed into place
+func getTmpDir() string {
+	tmpDir := filepath.Join(getPulseHome(), "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err == nil {
+		fixDirOwnership(tmpDir)
+	}
+	return tmpDir
 }
 
 func getImagesDir() string {
@@ -160,8 +381,3 @@ func getPulseHome() string {
 	}
 	return filepath.Join(homeDir, ".pulse")
 }
-
-func sanitize(image string) string {
-	replacer := strings.NewReplacer("/", "_", ":", "_")
-	return replacer.Replace(image)
-}
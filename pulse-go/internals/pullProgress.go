@@ -0,0 +1,90 @@
+package internals
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containers/image/v5/types"
+)
+
+// Statuses of pull events
+const (
+	PullStatusPulling     = "pulling"     // the pull started
+	PullStatusInfo        = "info"        // a step of the pull, in Message
+	PullStatusWarning     = "warning"     // something went wrong that the pull survived
+	PullStatusPolicy      = "policy"      // the signature policy decided, in Policy
+	PullStatusDownloading = "downloading" // a blob is being downloaded
+	PullStatusExists      = "exists"      // a blob is already in the store
+	PullStatusComplete    = "complete"    // a blob finished downloading
+	PullStatusDone        = "done"        // the pull succeeded; Digest is what was pulled
+	PullStatusError       = "error"       // the pull failed
+)
+
+// ErrPullCancelled is returned by a pull whose context was cancelled
+var ErrPullCancelled = errors.New("pull cancelled")
+
+// progressInterval is how often a blob being downloaded reports its progress
+const progressInterval = 200 * time.Millisecond
+
+// PullEvent is one step of a pull. The daemon streams them as newline-delimited JSON;
+// Message is the human-readable form of events that are not about a blob.
+type PullEvent struct {
+	Status  string          `json:"status"`
+	Pull    string          `json:"pull,omitempty"`    // ID of the pull in the daemon, on the first event
+	ID      string          `json:"id,omitempty"`      // digest of the blob
+	Current int64           `json:"current,omitempty"` // bytes of the blob downloaded
+	Total   int64           `json:"total,omitempty"`   // size of the blob, 0 if unknown
+	Message string          `json:"message,omitempty"`
+	Digest  string          `json:"digest,omitempty"`
+	Policy  *PolicyDecision `json:"policy,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// PullProgress receives the events of a pull
+type PullProgress func(PullEvent)
+
+func (p PullProgress) message(status, format string, args ...interface{}) {
+	p(PullEvent{Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// fail reports err as the end of the pull and returns it. Once ctx is cancelled the
+// error is whatever the cancellation broke, so ErrPullCancelled is reported instead.
+func (p PullProgress) fail(ctx context.Context, err error) (string, error) {
+	if ctx.Err() != nil {
+		p(PullEvent{Status: PullStatusError, Message: "🛑 Pull cancelled", Error: ErrPullCancelled.Error()})
+		return "", ErrPullCancelled
+	}
+	p(PullEvent{Status: PullStatusError, Message: fmt.Sprintf("❌ Pull failed: %v", err), Error: err.Error()})
+	return "", err
+}
+
+// reportBlobs turns copy.Image's progress into events until events is closed
+func (p PullProgress) reportBlobs(ctx context.Context, events <-chan types.ProgressProperties) {
+	for props := range events {
+		event := PullEvent{ID: props.Artifact.Digest.String()}
+		if props.Artifact.Size > 0 {
+			event.Total = props.Artifact.Size
+		}
+		switch props.Event {
+		case types.ProgressEventNewArtifact:
+			event.Status = PullStatusDownloading
+		case types.ProgressEventRead:
+			event.Status = PullStatusDownloading
+			event.Current = int64(props.Offset)
+		case types.ProgressEventDone:
+			// Done is also sent for a blob whose download was interrupted
+			if ctx.Err() != nil {
+				continue
+			}
+			event.Status = PullStatusComplete
+			event.Current = event.Total
+		case types.ProgressEventSkipped:
+			event.Status = PullStatusExists
+		default:
+			continue
+		}
+		p(event)
+	}
+}
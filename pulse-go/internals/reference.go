@@ -0,0 +1,53 @@
+package internals
+
+import (
+	"fmt"
+
+	"github.com/containers/image/v5/docker/reference"
+)
+
+// ParseImageReference normalizes an image name the way Docker does: the registry
+// defaults to docker.io, official images get library/, and a reference without a tag
+// or digest means :latest. "alpine" and "docker.io/library/alpine:latest" are the
+// same image.
+func ParseImageReference(image string) (reference.Named, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image reference %q: %v", image, err)
+	}
+	return reference.TagNameOnly(named), nil
+}
+
+// NormalizeImage returns the full registry/repository:tag[@digest] form of image
+func NormalizeImage(image string) (string, error) {
+	named, err := ParseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	return named.String(), nil
+}
+
+// FamiliarImage shortens a normalized reference for display, e.g. alpine:latest
+func FamiliarImage(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.FamiliarString(named)
+}
+
+// splitReference returns the repository, tag and digest parts of a normalized reference
+func splitReference(image string) (repository, tag, digest string) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image, "", ""
+	}
+	repository = reference.FamiliarName(named)
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		digest = digested.Digest().String()
+	}
+	return repository, tag, digest
+}
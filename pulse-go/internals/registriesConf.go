@@ -0,0 +1,199 @@
+package internals
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+)
+
+// RegistriesConfig is pulse's registries.conf. TLS is verified against the system
+// roots unless a registry says otherwise:
+//
+//	[[registry]]
+//	location = "registry.example.com:5000"
+//	certs_dir = "/etc/pulse/certs.d/registry.example.com:5000"
+//
+//	[[registry]]
+//	location = "docker.io"
+//	mirrors = ["mirror-a.internal:5000", "mirror-b.internal"]
+//
+//	[[registry]]
+//	location = "mirror-b.internal"
+//	insecure = true
+type RegistriesConfig struct {
+	Registries []RegistryConfig `toml:"registry"`
+
+	dir string // directory the file was read from, for the default certs.d
+}
+
+// RegistryConfig configures one registry, or a namespace of one (host[:port][/path])
+type RegistryConfig struct {
+	Location string `toml:"location"`
+	// Insecure skips TLS verification and allows plain HTTP
+	Insecure bool `toml:"insecure"`
+	// CertsDir holds *.crt CA certificates and *.cert/*.key client certificate pairs, like
+	// Docker's certs.d; it defaults to certs.d/<host> next to registries.conf
+	CertsDir string `toml:"certs_dir"`
+	// Mirrors are tried in order before Location, which is the last fallback
+	Mirrors []string `toml:"mirrors"`
+	// Lookaside is the URL of a server holding GPG (simple signing) signatures
+	Lookaside string `toml:"lookaside"`
+	// SigstoreAttachments reads sigstore signatures stored next to images in the registry
+	SigstoreAttachments bool `toml:"sigstore_attachments"`
+}
+
+// pullSource is one place an image can be pulled from
+type pullSource struct {
+	named  reference.Named
+	sys    *types.SystemContext
+	mirror bool
+}
+
+// LoadRegistriesConfig reads ~/.pulse/registries.conf, or /etc/pulse/registries.conf if
+// the user has none, or returns an empty configuration (every registry over verified
+// TLS, no mirrors)
+func LoadRegistriesConfig() (*RegistriesConfig, error) {
+	data, path, err := readPulseConfig("registries.conf")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return &RegistriesConfig{dir: systemConfigDir}, nil
+	}
+	return parseRegistriesConfig(path, data)
+}
+
+func parseRegistriesConfig(path string, data []byte) (*RegistriesConfig, error) {
+	conf := &RegistriesConfig{dir: filepath.Dir(path)}
+	meta, err := toml.Decode(string(data), conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	// A misspelt key would silently turn a setting off, so unknown keys are errors
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("invalid %s: unknown key %q", path, undecoded[0].String())
+	}
+
+	for i, r := range conf.Registries {
+		location := strings.TrimSuffix(r.Location, "/")
+		if location == "" || strings.Contains(location, "://") {
+			return nil, fmt.Errorf("invalid %s: registry location %q, expected host[:port][/path]", path, r.Location)
+		}
+		conf.Registries[i].Location = location
+		for _, mirror := range r.Mirrors {
+			if mirror == "" || strings.Contains(mirror, "://") {
+				return nil, fmt.Errorf("invalid %s: mirror %q of %s, expected host[:port][/path]", path, mirror, location)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// find returns the registry whose location is the longest prefix of name
+func (c *RegistriesConfig) find(name string) *RegistryConfig {
+	var best *RegistryConfig
+	for i, r := range c.Registries {
+		if name != r.Location && !strings.HasPrefix(name, r.Location+"/") {
+			continue
+		}
+		if best == nil || len(r.Location) > len(best.Location) {
+			best = &c.Registries[i]
+		}
+	}
+	return best
+}
+
+// SystemContext returns base with the TLS settings for the registry at location. It
+// ignores the system's containers registries.conf, so only pulse's file decides how
+// registries are reached.
+func (c *RegistriesConfig) SystemContext(base *types.SystemContext, location string) *types.SystemContext {
+	sys := *base
+	sys.SystemRegistriesConfPath = os.DevNull
+	sys.SystemRegistriesConfDirPath = os.DevNull
+	sys.DockerInsecureSkipTLSVerify = types.OptionalBoolFalse
+	sys.DockerPerHostCertDirPath = filepath.Join(c.dir, "certs.d")
+
+	if r := c.find(location); r != nil {
+		if r.Insecure {
+			sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+		}
+		if r.CertsDir != "" {
+			sys.DockerCertPath = r.CertsDir
+		}
+	}
+	return &sys
+}
+
+// writeSignatureStorage writes the registries.d file (containers-registries.d(5)) that
+// tells the image library where each registry's signatures are
+func (c *RegistriesConfig) writeSignatureStorage(dir string) error {
+	type namespace struct {
+		Lookaside           string `json:"lookaside,omitempty"`
+		SigstoreAttachments bool   `json:"use-sigstore-attachments,omitempty"`
+	}
+	docker := map[string]namespace{}
+	for _, r := range c.Registries {
+		if r.Lookaside != "" || r.SigstoreAttachments {
+			docker[r.Location] = namespace{Lookaside: r.Lookaside, SigstoreAttachments: r.SigstoreAttachments}
+		}
+	}
+
+	// JSON is valid YAML
+	data, err := json.Marshal(map[string]any{"docker": docker})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "pulse.yaml"), data, 0644)
+}
+
+// pullSources lists where named can be pulled from: the mirrors of its registry in
+// order, then the registry itself
+func (c *RegistriesConfig) pullSources(base *types.SystemContext, named reference.Named) ([]pullSource, error) {
+	r := c.find(named.Name())
+	if r == nil {
+		return []pullSource{{named: named, sys: c.SystemContext(base, named.Name())}}, nil
+	}
+
+	var sources []pullSource
+	for _, mirror := range r.Mirrors {
+		mirrored, err := rewriteReference(named, r.Location, mirror)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, pullSource{
+			named:  mirrored,
+			sys:    c.SystemContext(base, mirrored.Name()),
+			mirror: true,
+		})
+	}
+	sources = append(sources, pullSource{named: named, sys: c.SystemContext(base, named.Name())})
+	return sources, nil
+}
+
+// rewriteReference replaces the prefix of named's repository with location, keeping
+// its tag and digest
+func rewriteReference(named reference.Named, prefix, location string) (reference.Named, error) {
+	name := strings.TrimSuffix(location, "/") + strings.TrimPrefix(named.Name(), prefix)
+	if tagged, ok := named.(reference.Tagged); ok {
+		name += ":" + tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		name += "@" + digested.Digest().String()
+	}
+
+	rewritten, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror reference %q: %v", name, err)
+	}
+	// A host without a dot or port would be taken for a Docker Hub namespace
+	if host, _, _ := strings.Cut(location, "/"); reference.Domain(rewritten) != host {
+		return nil, fmt.Errorf("invalid mirror %q: the host needs a domain or port", location)
+	}
+	return rewritten, nil
+}
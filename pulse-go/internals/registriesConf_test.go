@@ -0,0 +1,182 @@
+package internals
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func testDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// testRegistry serves a single-layer linux/amd64 image as app:latest over TLS with
+// httptest's self-signed certificate. A failing registry answers the API ping but
+// nothing else; requests counts what it was asked for.
+func testRegistry(t *testing.T, failing bool) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	tw.WriteHeader(&tar.Header{Name: "hello", Typeflag: tar.TypeReg, Mode: 0644, Size: 2})
+	tw.Write([]byte("hi"))
+	tw.Close()
+
+	config, _ := json.Marshal(map[string]any{
+		"os":           "linux",
+		"architecture": "amd64",
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": []string{testDigest(layer.Bytes())}},
+	})
+	manifest, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]any{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": testDigest(config), "size": len(config)},
+		"layers":        []any{map[string]any{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": testDigest(layer.Bytes()), "size": layer.Len()}},
+	})
+	blobs := map[string][]byte{testDigest(config): config, testDigest(layer.Bytes()): layer.Bytes()}
+
+	requests := &atomic.Int32{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		requests.Add(1)
+		if failing {
+			http.Error(w, "mirror is down", http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/app/manifests/latest" || r.URL.Path == "/v2/app/manifests/"+testDigest(manifest):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Header().Set("Docker-Content-Digest", testDigest(manifest))
+			w.Header().Set("Content-Length", strconv.Itoa(len(manifest)))
+			if r.Method == http.MethodGet {
+				w.Write(manifest)
+			}
+		case strings.HasPrefix(r.URL.Path, "/v2/app/blobs/"):
+			blob, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/app/blobs/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.Write(blob)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// trustDir returns a certs_dir holding the CA of httptest's servers
+func trustDir(t *testing.T, server *httptest.Server) string {
+	t.Helper()
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// pullWithRegistriesConf pulls image into a fresh ~/.pulse configured by conf
+func pullWithRegistriesConf(t *testing.T, conf, image string) error {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SUDO_UID", "")
+
+	pulseHome := filepath.Join(home, ".pulse")
+	if err := os.MkdirAll(pulseHome, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"registries.conf": conf,
+		"policy.json":     `{"default": [{"type": "insecureAcceptAnything"}]}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(pulseHome, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caller := &user.User{Uid: strconv.Itoa(os.Getuid()), Username: "tester", HomeDir: home}
+	_, err := PullImage(context.Background(), image, PullOptions{Platform: "linux/amd64", User: caller}, nil)
+	return err
+}
+
+func TestPullTrustsCertsDir(t *testing.T) {
+	server, _ := testRegistry(t, false)
+	host := server.Listener.Addr().String()
+	conf := fmt.Sprintf("[[registry]]\nlocation = %q\ncerts_dir = %q\n", host, trustDir(t, server))
+
+	if err := pullWithRegistriesConf(t, conf, host+"/app:latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadImageRecord(host + "/app:latest"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPullInsecureRegistry(t *testing.T) {
+	server, _ := testRegistry(t, false)
+	host := server.Listener.Addr().String()
+	conf := fmt.Sprintf("[[registry]]\nlocation = %q\ninsecure = true\n", host)
+
+	if err := pullWithRegistriesConf(t, conf, host+"/app:latest"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPullRefusesUntrustedCertificate(t *testing.T) {
+	server, requests := testRegistry(t, false)
+	host := server.Listener.Addr().String()
+
+	err := pullWithRegistriesConf(t, "", host+"/app:latest")
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Errorf("registry served %d requests over an unverified connection", n)
+	}
+	if _, err := loadImageRecord(host + "/app:latest"); err == nil {
+		t.Error("image was recorded")
+	}
+}
+
+func TestPullFallsBackFromFailingMirror(t *testing.T) {
+	upstream, upstreamRequests := testRegistry(t, false)
+	mirror, mirrorRequests := testRegistry(t, true)
+	upstreamHost := upstream.Listener.Addr().String()
+	mirrorHost := mirror.Listener.Addr().String()
+
+	// httptest's servers share one certificate, so one certs_dir trusts both
+	certs := trustDir(t, upstream)
+	conf := fmt.Sprintf("[[registry]]\nlocation = %q\ncerts_dir = %q\nmirrors = [%q]\n\n[[registry]]\nlocation = %q\ncerts_dir = %q\n",
+		upstreamHost, certs, mirrorHost, mirrorHost, certs)
+
+	if err := pullWithRegistriesConf(t, conf, upstreamHost+"/app:latest"); err != nil {
+		t.Fatal(err)
+	}
+	if mirrorRequests.Load() == 0 {
+		t.Error("the mirror was not tried first")
+	}
+	if upstreamRequests.Load() == 0 {
+		t.Error("the upstream registry was not used")
+	}
+}
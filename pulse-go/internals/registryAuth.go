@@ -0,0 +1,362 @@
+package internals
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/types"
+)
+
+// authFile is the containers auth.json format (the "auths" part of Docker's
+// config.json). credHelpers and credsStore name docker-credential-<helper> programs
+// that hold the secrets instead of the file.
+type authFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredHelpers map[string]string    `json:"credHelpers,omitempty"`
+	CredsStore  string               `json:"credsStore,omitempty"`
+}
+
+type authEntry struct {
+	Auth          string `json:"auth,omitempty"` // base64 of username:password
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// helperCredentials is what credential helpers read and print
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// AuthFilePath returns the auth.json of u, ~/.pulse/auth.json. Credentials belong to
+// the user who runs the command, so unlike the stores this does not follow SUDO_UID.
+func AuthFilePath(u *user.User) string {
+	return filepath.Join(u.HomeDir, ".pulse", "auth.json")
+}
+
+// LookupUser returns the account with uid; the daemon uses it for the peer of a request
+func LookupUser(uid uint32) (*user.User, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %d: %v", uid, err)
+	}
+	return u, nil
+}
+
+// NormalizeRegistry maps the spellings of a registry to the key used in auth.json:
+// "https://index.docker.io/v1/" and "registry-1.docker.io" are "docker.io"
+func NormalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry = strings.TrimSuffix(registry, "/")
+	registry = strings.TrimSuffix(registry, "/v1")
+	registry = strings.TrimSuffix(registry, "/v2")
+	switch registry {
+	case "", "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	}
+	return registry
+}
+
+// readAuthFile reads u's auth file. The daemon reads it as root from a home directory u
+// controls, so a symlink is never followed and only a regular file owned by u is
+// accepted; anything else could be a file of another user that u pointed it at.
+func readAuthFile(u *user.User, path string) (*authFile, error) {
+	auths := &authFile{Auths: map[string]authEntry{}}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if os.IsNotExist(err) {
+		return auths, nil
+	}
+	if errors.Is(err, syscall.ELOOP) {
+		return nil, fmt.Errorf("refusing to read %s: it is a symlink", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("refusing to read %s: it is not a regular file", path)
+	}
+	if !ownedBy(info, u) {
+		return nil, fmt.Errorf("refusing to read %s: it is not owned by %s", path, u.Username)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, auths); err != nil {
+		return nil, fmt.Errorf("invalid auth file %s: %v", path, err)
+	}
+	if auths.Auths == nil {
+		auths.Auths = map[string]authEntry{}
+	}
+	return auths, nil
+}
+
+// writeAuthFile replaces the file atomically; it holds secrets so it is private to u
+func writeAuthFile(u *user.User, path string, auths *authFile) error {
+	data, err := json.MarshalIndent(auths, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	// Like the file itself, the directory must not lead root into someone else's
+	if info, err := os.Lstat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("refusing to write %s: %s is not a directory", path, dir)
+	}
+	chownToUser(u, dir)
+	tmp, err := os.CreateTemp(dir, ".auth-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	chownToUser(u, path)
+	return nil
+}
+
+// helperFor returns the credential helper that holds registry's secrets, if any
+func (a *authFile) helperFor(registry string) string {
+	if helper, ok := a.CredHelpers[registry]; ok {
+		return helper
+	}
+	return a.CredsStore
+}
+
+// lookup finds the entry for repository (registry/path), preferring the most specific
+// namespace, like containers-auth.json(5)
+func (a *authFile) lookup(repository string) (authEntry, bool) {
+	for key := repository; ; {
+		if entry, ok := a.Auths[key]; ok {
+			return entry, true
+		}
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+
+	registry, _, _ := strings.Cut(repository, "/")
+	for key, entry := range a.Auths {
+		if NormalizeRegistry(key) == registry {
+			return entry, true
+		}
+	}
+	return authEntry{}, false
+}
+
+// RegistryCredentials returns u's credentials for the registry serving named, or nil
+// when u has none. Credential helpers run as u, so a daemon running as root never
+// hands out its own secrets.
+func RegistryCredentials(u *user.User, named reference.Named) (*types.DockerAuthConfig, error) {
+	auths, err := readAuthFile(u, AuthFilePath(u))
+	if err != nil {
+		return nil, err
+	}
+
+	registry := reference.Domain(named)
+	if helper := auths.helperFor(registry); helper != "" {
+		out, err := runCredentialHelper(u, helper, "get", strings.NewReader(registry))
+		if err != nil {
+			// Helpers report a missing entry as an error; a pull may still work anonymously
+			if strings.Contains(err.Error(), "credentials not found") {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var creds helperCredentials
+		if err := json.Unmarshal(out, &creds); err != nil {
+			return nil, fmt.Errorf("invalid output from docker-credential-%s: %v", helper, err)
+		}
+		if creds.Username == "<token>" {
+			return &types.DockerAuthConfig{IdentityToken: creds.Secret}, nil
+		}
+		return &types.DockerAuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+	}
+
+	entry, ok := auths.lookup(named.Name())
+	if !ok {
+		return nil, nil
+	}
+	if entry.IdentityToken != "" {
+		return &types.DockerAuthConfig{IdentityToken: entry.IdentityToken}, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials for %s in %s: %v", registry, AuthFilePath(u), err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials for %s in %s", registry, AuthFilePath(u))
+	}
+	return &types.DockerAuthConfig{Username: username, Password: password}, nil
+}
+
+// registryContext adds u's credentials for named to a copy of sys
+func registryContext(sys *types.SystemContext, u *user.User, named reference.Named) (*types.SystemContext, error) {
+	if u == nil {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up the current user: %v", err)
+		}
+		u = current
+	}
+
+	creds, err := RegistryCredentials(u, named)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the credentials checked above are used. Without any, the pull is anonymous:
+	// left nil, the daemon's own auth files would be searched.
+	if creds == nil {
+		creds = &types.DockerAuthConfig{}
+	}
+	ctx := *sys
+	ctx.DockerAuthConfig = creds
+	return &ctx, nil
+}
+
+// Login checks the credentials against registry and stores them for u, in the
+// registry's credential helper if the auth file names one
+func Login(u *user.User, registry, username, password string) error {
+	registry = NormalizeRegistry(registry)
+	conf, err := LoadRegistriesConfig()
+	if err != nil {
+		return err
+	}
+	sys := conf.SystemContext(&types.SystemContext{}, registry)
+	if err := docker.CheckAuth(context.Background(), sys, username, password, registry); err != nil {
+		return fmt.Errorf("login to %s failed: %v", registry, err)
+	}
+
+	path := AuthFilePath(u)
+	auths, err := readAuthFile(u, path)
+	if err != nil {
+		return err
+	}
+
+	if helper := auths.helperFor(registry); helper != "" {
+		input, _ := json.Marshal(helperCredentials{ServerURL: registry, Username: username, Secret: password})
+		if _, err := runCredentialHelper(u, helper, "store", bytes.NewReader(input)); err != nil {
+			return err
+		}
+		// An inline entry would shadow the helper for other tools
+		delete(auths.Auths, registry)
+	} else {
+		auths.Auths[registry] = authEntry{
+			Auth: base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		}
+	}
+	return writeAuthFile(u, path, auths)
+}
+
+// Logout removes u's credentials for registry
+func Logout(u *user.User, registry string) error {
+	registry = NormalizeRegistry(registry)
+	path := AuthFilePath(u)
+	auths, err := readAuthFile(u, path)
+	if err != nil {
+		return err
+	}
+
+	removed := false
+	if helper := auths.helperFor(registry); helper != "" {
+		if _, err := runCredentialHelper(u, helper, "erase", strings.NewReader(registry)); err == nil {
+			removed = true
+		}
+	}
+	for key := range auths.Auths {
+		if NormalizeRegistry(key) == registry {
+			delete(auths.Auths, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return fmt.Errorf("not logged in to %s", registry)
+	}
+	return writeAuthFile(u, path, auths)
+}
+
+// runCredentialHelper runs docker-credential-<helper> <action> as u
+func runCredentialHelper(u *user.User, helper, action string, input io.Reader) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = input
+	cmd.Env = []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	if os.Geteuid() == 0 && u.Uid != "0" {
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String() + string(out))
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && msg != "" {
+			return nil, fmt.Errorf("docker-credential-%s %s: %s", helper, action, msg)
+		}
+		return nil, fmt.Errorf("docker-credential-%s %s: %v", helper, action, err)
+	}
+	return out, nil
+}
+
+// ownedBy reports whether info, from a stat of a path, belongs to u
+func ownedBy(info os.FileInfo, u *user.User) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && strconv.FormatUint(uint64(st.Uid), 10) == u.Uid
+}
+
+// chownToUser gives u files the daemon (as root) writes into u's home. A symlink that
+// u swapped in meanwhile is changed itself, not what it points to.
+func chownToUser(u *user.User, path string) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	uid, err1 := strconv.Atoi(u.Uid)
+	gid, err2 := strconv.Atoi(u.Gid)
+	if err1 == nil && err2 == nil {
+		os.Lchown(path, uid, gid)
+	}
+}
@@ -0,0 +1,130 @@
+package internals
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks matches the kernel's limit on symlinks followed during one lookup
+const maxSymlinks = 40
+
+// escapesRoot reports whether an archive path climbs above the archive root with ".."
+func escapesRoot(name string) bool {
+	clean := filepath.Clean(strings.TrimLeft(name, "/"))
+	return clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// resolveInRoot maps an absolute in-container path to a host path below root, the way
+// openat2(RESOLVE_IN_ROOT) would: every symlink in the parent directories is followed
+// as if root were "/", and ".." never climbs above root. The final component is not
+// followed, so callers can replace or create it without writing through a symlink.
+func resolveInRoot(root, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return root, nil
+	}
+
+	parent, err := resolveDirInRoot(root, filepath.Dir(name), false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, parent, filepath.Base(name)), nil
+}
+
+// resolveBeneath is resolveInRoot for the untrusted paths of layer entries, like
+// openat2(RESOLVE_BENEATH): a symlink in the parent directories with an absolute target,
+// or one that climbs above root, is an error instead of being followed inside root.
+// Layers built from a real filesystem never write through such symlinks.
+func resolveBeneath(root, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return root, nil
+	}
+
+	parent, err := resolveDirInRoot(root, filepath.Dir(name), true)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, parent, filepath.Base(name)), nil
+}
+
+// resolveFullInRoot is resolveInRoot that also follows a symlink in the final component,
+// for paths such as mount points that are used rather than replaced
+func resolveFullInRoot(root, name string) (string, error) {
+	resolved, err := resolveDirInRoot(root, name, false)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// resolveDirInRoot returns the symlink-free path (relative to root, starting with "/")
+// that dir refers to inside root. Components that do not exist yet are kept as is.
+// With beneath set, absolute symlinks and ".." above root are errors.
+func resolveDirInRoot(root, dir string, beneath bool) (string, error) {
+	resolved := "/"
+	remaining := dir
+	followed := 0
+
+	for remaining != "" {
+		var component string
+		remaining = strings.TrimLeft(remaining, "/")
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			component, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			component, remaining = remaining, ""
+		}
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if beneath && resolved == "/" {
+				return "", fmt.Errorf("%s climbs above the rootfs", dir)
+			}
+			// filepath.Dir("/") is "/", so this is clamped at root
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			if !info.IsDir() && remaining != "" {
+				return "", fmt.Errorf("%s is not a directory", next)
+			}
+			resolved = next
+			continue
+		}
+
+		followed++
+		if followed > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s", dir)
+		}
+
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		// Absolute targets restart from root, relative ones from the link's directory
+		if filepath.IsAbs(link) {
+			if beneath {
+				return "", fmt.Errorf("%s is a symlink to the absolute path %s", next, link)
+			}
+			resolved = "/"
+		}
+		remaining = link + "/" + remaining
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,280 @@
+package internals
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+)
+
+// SignaturePolicy is pulse's policy.json. Requirements are picked by the longest
+// registry scope (host[:port][/path]) that contains the image, falling back to default,
+// and every requirement of that scope must accept the image:
+//
+//	{
+//	  "default": [{"type": "reject"}],
+//	  "registries": {
+//	    "docker.io/library": [{"type": "insecureAcceptAnything"}],
+//	    "registry.example.com": [{"type": "signedBy", "keyPath": "/etc/pulse/keys/example.gpg"}],
+//	    "ghcr.io/example": [{"type": "sigstoreSigned", "keyPath": "/etc/pulse/keys/cosign.pub"}]
+//	  }
+//	}
+type SignaturePolicy struct {
+	Default    []PolicyRequirement            `json:"default"`
+	Registries map[string][]PolicyRequirement `json:"registries,omitempty"`
+}
+
+// PolicyRequirement is one rule: reject, insecureAcceptAnything, signedBy (GPG keys)
+// or sigstoreSigned (sigstore public keys)
+type PolicyRequirement struct {
+	Type     string   `json:"type"`
+	KeyPath  string   `json:"keyPath,omitempty"`
+	KeyPaths []string `json:"keyPaths,omitempty"`
+}
+
+// PolicyDecision says which requirement accepted or rejected an image
+type PolicyDecision struct {
+	Scope       string `json:"scope"`
+	Requirement string `json:"requirement"`
+	Accepted    bool   `json:"accepted"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// ErrNoSignaturePolicy is returned when neither policy file exists
+var ErrNoSignaturePolicy = errors.New("no signature policy")
+
+// LoadSignaturePolicy reads and checks ~/.pulse/policy.json, or /etc/pulse/policy.json
+// if the user has none, wrapping ErrNoSignaturePolicy if neither exists. As root, the
+// user's file only counts if root owns it (see readUserConfig), so a user cannot
+// loosen the policy of the daemon.
+func LoadSignaturePolicy() (*SignaturePolicy, error) {
+	data, path, err := readPulseConfig("policy.json")
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%w (looked for %s and %s)", ErrNoSignaturePolicy,
+			filepath.Join(getPulseHome(), "policy.json"), filepath.Join(systemConfigDir, "policy.json"))
+	}
+
+	policy := &SignaturePolicy{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(policy); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", path, err)
+	}
+	return policy, nil
+}
+
+// insecurePolicy stands in when there is no policy file and none is required; the
+// decision it reports says so
+func insecurePolicy() *SignaturePolicy {
+	return &SignaturePolicy{
+		Default: []PolicyRequirement{{Type: "insecureAcceptAnything"}},
+	}
+}
+
+func (p *SignaturePolicy) validate() error {
+	if len(p.Default) == 0 {
+		return errors.New(`"default" needs at least one requirement`)
+	}
+	for _, req := range p.Default {
+		if err := req.validate(); err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+	}
+	for scope, reqs := range p.Registries {
+		if scope == "" || strings.Contains(scope, "://") {
+			return fmt.Errorf("invalid scope %q, expected host[:port][/path]", scope)
+		}
+		if len(reqs) == 0 {
+			return fmt.Errorf("%s: needs at least one requirement", scope)
+		}
+		for _, req := range reqs {
+			if err := req.validate(); err != nil {
+				return fmt.Errorf("%s: %v", scope, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r PolicyRequirement) keyPaths() []string {
+	if r.KeyPath != "" {
+		return append([]string{r.KeyPath}, r.KeyPaths...)
+	}
+	return r.KeyPaths
+}
+
+func (r PolicyRequirement) validate() error {
+	switch r.Type {
+	case "reject", "insecureAcceptAnything":
+		if len(r.keyPaths()) > 0 {
+			return fmt.Errorf("%s takes no keys", r.Type)
+		}
+		return nil
+	case "signedBy", "sigstoreSigned":
+		if len(r.keyPaths()) == 0 {
+			return fmt.Errorf("%s needs keyPath or keyPaths", r.Type)
+		}
+		// A missing key would reject every image with a confusing error at pull time
+		for _, path := range r.keyPaths() {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("%s key: %v", r.Type, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown requirement type %q", r.Type)
+}
+
+func (r PolicyRequirement) String() string {
+	if keys := r.keyPaths(); len(keys) > 0 {
+		return fmt.Sprintf("%s(%s)", r.Type, strings.Join(keys, ", "))
+	}
+	return r.Type
+}
+
+// requirementsFor returns the scope that applies to named and its requirements
+func (p *SignaturePolicy) requirementsFor(named reference.Named) (string, []PolicyRequirement) {
+	name := named.Name()
+	best := ""
+	for scope := range p.Registries {
+		if name != scope && !strings.HasPrefix(name, scope+"/") {
+			continue
+		}
+		if len(scope) > len(best) {
+			best = scope
+		}
+	}
+	if best == "" {
+		return "default", p.Default
+	}
+	return best, p.Registries[best]
+}
+
+// build turns the requirement into the library's. Signatures must name repository
+// (the image as requested, not the mirror it came from); the pull is pinned to a
+// digest, so the digest binds the signature to the content.
+func (r PolicyRequirement) build(repository string) (signature.PolicyRequirement, error) {
+	switch r.Type {
+	case "reject":
+		return signature.NewPRReject(), nil
+	case "insecureAcceptAnything":
+		return signature.NewPRInsecureAcceptAnything(), nil
+	}
+
+	identity, err := signature.NewPRMExactRepository(repository)
+	if err != nil {
+		return nil, err
+	}
+	if r.Type == "signedBy" {
+		return signature.NewPRSignedByKeyPaths(signature.SBKeyTypeGPGKeys, r.keyPaths(), identity)
+	}
+	return signature.NewPRSigstoreSigned(
+		signature.PRSigstoreSignedWithKeyPaths(r.keyPaths()),
+		signature.PRSigstoreSignedWithSignedIdentity(identity),
+	)
+}
+
+// imagePolicy is the part of the policy that applies to one image
+type imagePolicy struct {
+	scope      string
+	reqs       []PolicyRequirement
+	repository string
+	ctx        *signature.PolicyContext // all of reqs, enforced again by copy.Image
+}
+
+func (p *SignaturePolicy) forImage(named reference.Named) (*imagePolicy, error) {
+	scope, reqs := p.requirementsFor(named)
+	repository := reference.TrimNamed(named).String()
+
+	policy, err := policyFor(reqs, repository)
+	if err != nil {
+		return nil, err
+	}
+	policyCtx, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create policy context: %v", err)
+	}
+	return &imagePolicy{scope: scope, reqs: reqs, repository: repository, ctx: policyCtx}, nil
+}
+
+func (ip *imagePolicy) Destroy() {
+	ip.ctx.Destroy()
+}
+
+// policyFor returns the library policy that enforces reqs
+func policyFor(reqs []PolicyRequirement, repository string) (*signature.Policy, error) {
+	policy := &signature.Policy{}
+	for _, req := range reqs {
+		built, err := req.build(repository)
+		if err != nil {
+			return nil, fmt.Errorf("invalid requirement %s: %v", req, err)
+		}
+		policy.Default = append(policy.Default, built)
+	}
+	return policy, nil
+}
+
+// check evaluates the requirements one by one against the image at src so the decision
+// can name the requirement that rejected it, or the ones that accepted it
+func (ip *imagePolicy) check(ctx context.Context, src pullSource, pinned string) (*PolicyDecision, error) {
+	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", pinned))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name: %v", err)
+	}
+	imageSource, err := srcRef.NewImageSource(ctx, src.sys)
+	if err != nil {
+		return nil, err
+	}
+	defer imageSource.Close()
+	unparsed := image.UnparsedInstance(imageSource, nil)
+
+	var accepted []string
+	for _, req := range ip.reqs {
+		policy, err := policyFor([]PolicyRequirement{req}, ip.repository)
+		if err != nil {
+			return nil, err
+		}
+		policyCtx, err := signature.NewPolicyContext(policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create policy context: %v", err)
+		}
+		allowed, err := policyCtx.IsRunningImageAllowed(ctx, unparsed)
+		policyCtx.Destroy()
+
+		if !allowed {
+			decision := &PolicyDecision{Scope: ip.scope, Requirement: req.String()}
+			if err != nil {
+				decision.Reason = err.Error()
+			}
+			return decision, nil
+		}
+		accepted = append(accepted, req.String())
+	}
+	return &PolicyDecision{Scope: ip.scope, Requirement: strings.Join(accepted, " and "), Accepted: true}, nil
+}
+
+func (d *PolicyDecision) String() string {
+	if d.Accepted {
+		return fmt.Sprintf("🔏 Accepted by %s (policy scope %s)", d.Requirement, d.Scope)
+	}
+	msg := fmt.Sprintf("🚫 Rejected by %s (policy scope %s)", d.Requirement, d.Scope)
+	if d.Reason != "" {
+		msg += ": " + d.Reason
+	}
+	return msg
+}